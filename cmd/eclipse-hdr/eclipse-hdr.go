@@ -11,29 +11,77 @@ var(
 	fVerbosity int
 	fOutputWidth float64
 	fDoEclipseAlignment bool
+	fLimbFinder string
+	fReferenceLayer string
 	fDoFineTunedAlignment bool
+	fAlignStrategy string
+	fAlignRefine string
+	fAlignRefineStall int
+	fAlignMetric string
+	fDoAlignmentCache bool
+	fDoResponseCurve bool
+	fDoExposureCalibration bool
+	fOrientNorth string
+	fPipeline string
 	fFuser string
 	fDeveloper string
 	fTonemapper string
 	fFuserLuminance float64
+	fFuserFeatherWidth float64
+	fStackSigmaClip float64
+	fClipFraction float64
+	fDoClippingMask bool
+	fGhostThreshold float64
+	fLSAngleDeg float64
+	fLSRadialShift float64
+	fLSBlend float64
 )
 
 func init() {
+	// Flags that aren't set leave conf.yaml alone, so they default to the same values it does
+	defaults := eclipse.NewConfig()
+
 	flag.IntVar(&fVerbosity, "v", 0, "how verbose to get")
-	flag.Float64Var(&fOutputWidth, "width", 4, "width of output image, in solar diameters")
+	flag.Float64Var(&fOutputWidth, "width", defaults.OutputWidthInSolarDiameters, "width of output image, in solar diameters")
+
+	flag.BoolVar(&fDoEclipseAlignment, "aligneclipse", defaults.DoEclipseAlignment, "assume pics are of an eclipse, and try to align them")
+	flag.StringVar(&fLimbFinder, "limbfinder", defaults.LimbFinder, "how to find the lunar limb: [floodfill hough]")
+	flag.StringVar(&fReferenceLayer, "reflayer", "", "which layer to align the others to: a filename, an EV, or auto (best lunar limb); default is the first")
+	flag.BoolVar(&fDoFineTunedAlignment, "alignfinetune", false, "do an extra pass to finetune image alignment")
+	flag.StringVar(&fAlignStrategy, "alignstrategy", defaults.AlignStrategy, "how to finetune the alignment: [phasecorr fouriermellin bruteforce]")
+	flag.StringVar(&fAlignRefine, "alignrefine", defaults.AlignRefine, "how bruteforce alignment does its final sub-pixel pass: [grid neldermead]")
+	flag.IntVar(&fAlignRefineStall, "alignrefinestall", defaults.AlignRefineStallIterations, "for -alignrefine=neldermead, give up after this many iterations without improvement")
+	flag.StringVar(&fAlignMetric, "alignmetric", defaults.AlignMetric, "how to score how well images align: [mad ncc gradient mi]")
+	flag.BoolVar(&fDoAlignmentCache, "aligncache", defaults.DoAlignmentCache, "reuse finetuned alignments from a cache file next to the photos (and save new ones there)")
+	flag.BoolVar(&fDoResponseCurve, "responsecurve", false, "estimate the camera response curve from the aligned images")
+	flag.BoolVar(&fDoExposureCalibration, "calibrateexposures", false, "measure the true exposure ratios between layers, instead of trusting EXIF")
 
-	flag.BoolVar(&fDoEclipseAlignment, "aligneclipse", true, "assume pics are of an eclipse, and try to align them")
-	flag.BoolVar(&fDoFineTunedAlignment, "alignfinetune", false, "do a very slow pass to finetune image alignment")
+	flag.StringVar(&fOrientNorth, "northup", "", "rotate the output so north is up (needs location & timestamps; hdr pipeline only): [celestial solar]")
 
-	flag.StringVar(&fFuser, "fuser", "mostexposed", "how to fuse the exposures into one HDR exposure")
-	flag.StringVar(&fDeveloper, "developer", "dng", "how to develop the color (prior to tonemapping)")
-	flag.StringVar(&fTonemapper, "tonemapper", "all", "how to tonemap from HDR to LDR: "+eclipse.ListTonemappers())
-	flag.Float64Var(&fFuserLuminance, "fuserluminance", 0.8, "layer discarded during fusion if pixel>this (0.0->1.0) ")
+	flag.StringVar(&fPipeline, "pipeline", "hdr", "how to combine the aligned exposures: [hdr mertens]; mertens does exposure fusion straight to mertens.png, no HDR or tonemapping")
+	flag.StringVar(&fFuser, "fuser", defaults.Fuser, "how to fuse the exposures into one HDR exposure: [mostexposed feather weighted avg sector]")
+	flag.StringVar(&fDeveloper, "developer", defaults.Developer, "how to develop the color (prior to tonemapping)")
+	flag.StringVar(&fTonemapper, "tonemapper", defaults.Tonemapper, "how to tonemap from HDR to LDR: "+eclipse.ListTonemappers())
+	flag.Float64Var(&fFuserLuminance, "fuserluminance", defaults.FuserLuminance, "layer discarded during fusion if pixel>this (0.0->1.0) ")
+	flag.Float64Var(&fFuserFeatherWidth, "featherwidth", defaults.FuserFeatherWidth, "for -fuser=feather, fade between layers over this range of luminance (0.0->1.0)")
+	flag.Float64Var(&fClipFraction, "clipfraction", defaults.ClipFraction, "samples above this fraction of the camera's white level count as clipped, and aren't fused")
+	flag.BoolVar(&fDoClippingMask, "clipmask", false, "write clipping.png, showing where clipped samples were skipped")
+	flag.Float64Var(&fGhostThreshold, "ghost", 0.0, "reject a layer at a pixel if it's this far (e.g. 0.5 = 50%) from the other layers, and write ghosts.png; 0 to skip it")
+	flag.Float64Var(&fStackSigmaClip, "stacksigma", defaults.StackSigmaClip, "when stacking photos with the same exposure, reject samples this many std devs out")
+	flag.Float64Var(&fLSAngleDeg, "lsangle", 0.0, "rotational shift (deg) for the Larson-Sekanina filter (hdr pipeline only); 0 to skip it")
+	flag.Float64Var(&fLSRadialShift, "lsradial", 0.0, "radial shift (pixels) for the Larson-Sekanina filter")
+	flag.Float64Var(&fLSBlend, "lsblend", defaults.LarsonSekaninaBlend, "how much of the Larson-Sekanina filter to blend into the HDR image")
 	flag.Parse()
 
-	// If finetuning, pick smaller images
-	if fDoFineTunedAlignment {
-		fOutputWidth = 2.0
+	if fPipeline != "hdr" && fPipeline != "mertens" {
+		log.Fatalf("no pipeline named '%s'", fPipeline)
+	}
+
+	// Catch bad strategy names now, rather than after loading all the photos
+	flagConfig := eclipse.NewConfig()
+	applyFlags(&flagConfig)
+	if err := flagConfig.Validate(); err != nil {
+		log.Fatal(err)
 	}
 
 	log.Printf("eclipse-hdr starting\n")
@@ -46,21 +94,95 @@ func main() {
 		log.Fatal(err)
 	}
 
-	img.Config.Fuser = fFuser
-	img.Config.Developer = fDeveloper
-	img.Config.Tonemapper = fTonemapper
-	img.Config.OutputWidthInSolarDiameters = fOutputWidth
-	img.Config.DoEclipseAlignment = fDoEclipseAlignment
-	img.Config.DoFineTunedAlignment = fDoFineTunedAlignment
-	img.Config.Verbosity = fVerbosity
-	img.Config.FuserLuminance = fFuserLuminance
+	applyFlags(&img.Config)
+
+	// If brute-force finetuning, pick smaller images (unless a width was asked for)
+	if img.Config.DoFineTunedAlignment && img.Config.AlignStrategy == "bruteforce" &&
+		!flagWasSet("width") && img.Config.OutputWidthInSolarDiameters == eclipse.NewConfig().OutputWidthInSolarDiameters {
+		img.Config.OutputWidthInSolarDiameters = 2.0
+	}
 
 	if img.Config.Verbosity > 0 {
 		log.Printf("Initial configuration:-\n\n%s\n", img.Config.AsYaml())
 	}
 
-	img.Align()
+	if err := img.Align(); err != nil {
+		log.Fatal(err)
+	}
+	if img.Config.DoResponseCurve {
+		if err := img.EstimateResponseCurve(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if fPipeline == "mertens" {
+		// Exposure fusion never builds the HDR image, which is what gets rotated & filtered
+		if img.Config.OrientNorth != "" || img.Config.LarsonSekaninaAngleDeg != 0.0 {
+			log.Printf("Ignoring north-up and Larson-Sekanina settings; they only apply to the hdr pipeline\n")
+		}
+		if err := img.ExposureFusion("mertens.png"); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	img.CalibrateExposures()
 	img.Fuse()
+	if err := img.OrientNorthUp(); err != nil {
+		log.Fatal(err)
+	}
 	img.WriteToHDR("fused.hdr")
+	if fDoClippingMask {
+		img.WriteClippingMask("clipping.png")
+	}
+	if img.Config.GhostThreshold > 0.0 {
+		img.WriteGhostMask("ghosts.png")
+	}
+	if err := img.ApplyLarsonSekanina(); err != nil {
+		log.Fatal(err)
+	}
 	img.Tonemap()
 }
+
+func flagWasSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name { set = true }
+	})
+	return set
+}
+
+// applyFlags copies the flags into the config. Only the ones that were
+// actually set are copied, so they override conf.yaml without
+// clobbering everything else in it.
+func applyFlags(cfg *eclipse.Config) {
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "v":                  cfg.Verbosity = fVerbosity
+		case "width":              cfg.OutputWidthInSolarDiameters = fOutputWidth
+		case "aligneclipse":       cfg.DoEclipseAlignment = fDoEclipseAlignment
+		case "limbfinder":         cfg.LimbFinder = fLimbFinder
+		case "reflayer":           cfg.ReferenceLayer = fReferenceLayer
+		case "alignfinetune":      cfg.DoFineTunedAlignment = fDoFineTunedAlignment
+		case "alignstrategy":      cfg.AlignStrategy = fAlignStrategy
+		case "alignrefine":        cfg.AlignRefine = fAlignRefine
+		case "alignrefinestall":   cfg.AlignRefineStallIterations = fAlignRefineStall
+		case "alignmetric":        cfg.AlignMetric = fAlignMetric
+		case "aligncache":         cfg.DoAlignmentCache = fDoAlignmentCache
+		case "responsecurve":      cfg.DoResponseCurve = fDoResponseCurve
+		case "calibrateexposures": cfg.DoExposureCalibration = fDoExposureCalibration
+		case "northup":            cfg.OrientNorth = fOrientNorth
+		case "fuser":              cfg.Fuser = fFuser
+		case "developer":          cfg.Developer = fDeveloper
+		case "tonemapper":         cfg.Tonemapper = fTonemapper
+		case "fuserluminance":     cfg.FuserLuminance = fFuserLuminance
+		case "featherwidth":       cfg.FuserFeatherWidth = fFuserFeatherWidth
+		case "clipfraction":       cfg.ClipFraction = fClipFraction
+		case "ghost":              cfg.GhostThreshold = fGhostThreshold
+		case "stacksigma":         cfg.StackSigmaClip = fStackSigmaClip
+		case "lsangle":            cfg.LarsonSekaninaAngleDeg = fLSAngleDeg
+		case "lsradial":           cfg.LarsonSekaninaRadialShift = fLSRadialShift
+		case "lsblend":            cfg.LarsonSekaninaBlend = fLSBlend
+		}
+	})
+}
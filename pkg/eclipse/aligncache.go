@@ -0,0 +1,125 @@
+package eclipse
+
+import(
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v2"
+)
+
+const alignmentCacheFilename = "eclipse-hdr-alignments.yaml"
+
+// An AlignmentCache remembers the alignments we've computed, in a
+// sidecar file next to the photos, so later runs don't need to
+// recompute them (or have them pasted into conf.yaml).
+//
+// Entries are keyed by a hash of the contents of both photos, and all
+// the config that affects the alignment; so if anything changes, the
+// old entries just stop being used.
+type AlignmentCache struct {
+	Filename string
+	Entries  map[string]AlignmentTransform
+
+	hashes   map[string]string // content hashes of the files we've looked at
+	dirty    bool
+}
+
+// LoadAlignmentCache reads the cache file, if there is one.
+func LoadAlignmentCache(dir string) *AlignmentCache {
+	ac := &AlignmentCache{
+		Filename: filepath.Join(dir, alignmentCacheFilename),
+		Entries:  map[string]AlignmentTransform{},
+		hashes:   map[string]string{},
+	}
+
+	contents, err := ioutil.ReadFile(ac.Filename)
+	if err != nil {
+		return ac // not there yet
+	}
+	if err := yaml.Unmarshal(contents, &ac.Entries); err != nil {
+		log.Printf("Ignoring alignment cache %s: %v\n", ac.Filename, err)
+		ac.Entries = map[string]AlignmentTransform{}
+	}
+	log.Printf("Loaded %d cached alignments from %s\n", len(ac.Entries), ac.Filename)
+
+	return ac
+}
+
+func (ac *AlignmentCache)Save() error {
+	if !ac.dirty {
+		return nil
+	}
+	b, err := yaml.Marshal(ac.Entries)
+	if err != nil {
+		return fmt.Errorf("alignment cache: %v", err)
+	}
+	if err := ioutil.WriteFile(ac.Filename, b, 0644); err != nil {
+		return fmt.Errorf("alignment cache: %v", err)
+	}
+	log.Printf("Saved %d alignments to %s\n", len(ac.Entries), ac.Filename)
+	ac.dirty = false
+	return nil
+}
+
+func (ac *AlignmentCache)Get(key string) (AlignmentTransform, bool) {
+	xform, exists := ac.Entries[key]
+	return xform, exists
+}
+
+func (ac *AlignmentCache)Put(key string, xform AlignmentTransform) {
+	ac.Entries[key] = xform
+	ac.dirty = true
+}
+
+// Key returns the cache key for aligning l2 onto l1.
+func (ac *AlignmentCache)Key(cfg Config, l1, l2 *Layer) (string, error) {
+	h1, err := ac.hashFile(l1.LoadFilename)
+	if err != nil {
+		return "", err
+	}
+	h2, err := ac.hashFile(l2.LoadFilename)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%s\n", h1, h2, alignmentParams(cfg))
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+func (ac *AlignmentCache)hashFile(filename string) (string, error) {
+	if hash, exists := ac.hashes[filename]; exists {
+		return hash, nil
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", fmt.Errorf("alignment cache: %v", err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("alignment cache: hashing %s: %v", filename, err)
+	}
+
+	ac.hashes[filename] = fmt.Sprintf("%x", h.Sum(nil))
+	return ac.hashes[filename], nil
+}
+
+// alignmentParams lists the config that can change the result of an
+// alignment. The search strategy and the input area are left out on
+// purpose: the transforms are in full-image coordinates, so one found
+// by a slow bruteforce run (on a narrower input area) should still be
+// picked up by the quicker runs that follow it.
+func alignmentParams(cfg Config) string {
+	return fmt.Sprintf("refine=%s metric=%s tol=%g maxiter=%d stall=%d limb=%s/%g site=%g,%g,%g",
+		cfg.AlignRefine, cfg.AlignMetric, cfg.AlignRefineTolerance,
+		cfg.AlignRefineMaxIterations, cfg.AlignRefineStallIterations, cfg.LimbFinder, cfg.LunarRadiusPix,
+		cfg.ObserverLatitude, cfg.ObserverLongitude, cfg.CameraUTCOffsetHours)
+}
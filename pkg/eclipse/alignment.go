@@ -7,6 +7,7 @@ import(
 	"math"
 	"strings"
 	"sync"
+	"time"
 
 	"golang.org/x/image/draw"      // replace by "image/draw" at some point
 	"golang.org/x/image/math/f64"  // replace by "image/math/f64" at some point
@@ -27,6 +28,7 @@ type AlignmentTransform struct {
 	RotationCenterX float64
 	RotationCenterY float64
 	RotateByDeg     float64
+	ScaleBy         float64 // 0.0 means no scaling (same as 1.0)
 
 	ErrorMetric     float64
 }
@@ -36,6 +38,9 @@ func (xform AlignmentTransform)String() string {
 	if xform.RotateByDeg != 0.0 {
 		str += fmt.Sprintf(", %5.2fdeg", xform.RotateByDeg)
 	}
+	if s := xform.Scale(); s != 1.0 {
+		str += fmt.Sprintf(", x%.4f", s)
+	}
 	if xform.ErrorMetric != 0.0 {
 		str += fmt.Sprintf(", err:%6.0f", xform.ErrorMetric)
 	}
@@ -48,11 +53,23 @@ func (xform AlignmentTransform)XFormImage(src image.Image) image.Image {
 	return dst
 }
 
+// Scale returns the scale factor; older config files won't have one.
+func (at AlignmentTransform)Scale() float64 {
+	if at.ScaleBy == 0.0 {
+		return 1.0
+	}
+	return at.ScaleBy
+}
+
 func (at AlignmentTransform)ToMatrix() emath.Aff3 {
 	// Step 1: translate so lunar limb centers are coincident
 	m := emath.Identity().Translate(at.TranslateByX, at.TranslateByY)
 
-	// [TBD] Step 2: scale (about lunar center) so that lunar radius is the same
+	// Step 2: scale (about lunar center) so that lunar radius is the same
+	if s := at.Scale(); s != 1.0 {
+		mS := emath.ScaleAbout(s, at.RotationCenterX, at.RotationCenterY)
+		m = mS.Mult(m)
+	}
 
 	// Step 3: rotate (about lunar center) so that coronas match
 	if at.RotateByDeg != 0 {
@@ -65,126 +82,215 @@ func (at AlignmentTransform)ToMatrix() emath.Aff3 {
 
 // AlignLayer figures out the transform that aligns `l2` to `l1`. it
 // then uses it to generate l2.Image, which will be pixel-aligned
-// with l1.Image.
-func AlignLayer(cfg Config, l1, l2 *Layer) {
+// with l1.Image. If there's a cache (it can be nil), finetuned
+// alignments are saved into it; they are taken from it only when
+// finetuning wasn't asked for, so -alignfinetune always recomputes.
+func AlignLayer(cfg Config, l1, l2 *Layer, cache *AlignmentCache) error {
 	// To get us in the ballpark, just map the center of the lunar
 	// limbs. This works better than you'd think, given that the lunar
 	// limb is itself moving relative to the sun (it's only there for
 	// the duration of totality !)
-	cent1 := l1.LunarLimb.Center()
-	cent2 := l2.LunarLimb.Center()
+	x1, y1 := l1.LunarLimb.PreciseCenter()
+	x2, y2 := l2.LunarLimb.PreciseCenter()
 
 	// Translate s2's lunar limb so that its center lines up with s1's lunar limb center
 	xform := AlignmentTransform{
 		Name: strings.ReplaceAll(fmt.Sprintf("%s-%s", l1.Filename(), l2.Filename()), ".tif", ""),
-		RotationCenterX: float64(cent1.X), // this rotationcenter is a bit approximate
-		RotationCenterY: float64(cent1.Y),
-		TranslateByX: float64(cent1.X-cent2.X),
-		TranslateByY: float64(cent1.Y-cent2.Y),
+		RotationCenterX: x1,
+		RotationCenterY: y1,
+		TranslateByX: x1-x2,
+		TranslateByY: y1-y2,
+		ScaleBy: 1.0,
 	}
 
-	if cfg.DoFineTunedAlignment {
-		xform = AlignLayerFine(cfg, l1, l2, xform)
-		cfg.Alignments[xform.Name] = xform
+	// If we know when & where the photos were taken, we know how much
+	// the sky rotated between them.
+	if rot, ok := FieldRotation(cfg, l1, l2); ok {
+		xform.RotateByDeg = rot
+		log.Printf("Field rotation from %s to %s: %.3f deg\n", l1.Filename(), l2.Filename(), rot)
+	}
+
+	cacheKey := ""
+	if cache != nil {
+		if key, err := cache.Key(cfg, l1, l2); err != nil {
+			log.Printf("Not caching alignment: %v\n", err)
+		} else {
+			cacheKey = key
+		}
+	}
+	cached, isCached := AlignmentTransform{}, false
+	if cacheKey != "" && !cfg.DoFineTunedAlignment {
+		cached, isCached = cache.Get(cacheKey)
+	}
 
-	} else if xf, exists := cfg.Alignments[xform.Name]; exists {
+	if xf, exists := cfg.Alignments[xform.Name]; exists && !cfg.DoFineTunedAlignment {
 		log.Printf("Using fine alignment from config file: %s\n", xf)
 		xform = xf
+
+	} else if isCached {
+		log.Printf("Using fine alignment from %s: %s\n", cache.Filename, cached)
+		xform = cached
+		cfg.Alignments[xform.Name] = xform
+
+	} else if cfg.DoFineTunedAlignment {
+		aligner, err := cfg.GetFineAligner()
+		if err != nil {
+			return err
+		}
+		if xform, err = aligner(cfg, l1, l2, xform); err != nil {
+			return err
+		}
+		cfg.Alignments[xform.Name] = xform
+		if cacheKey != "" {
+			cache.Put(cacheKey, xform)
+		}
 	}
 
 	l2.AlignmentTransform = xform
 	l2.Image = xform.XFormImage(l2.LoadedImage)
+	return nil
+}
+
+// FieldRotation returns the rotation (for AlignmentTransform) that
+// undoes the rotation of the sky between the two photos, for a camera
+// on an alt-az mount (or a tripod); it needs the observer location in
+// the config, and timestamps in the EXIF data.
+func FieldRotation(cfg Config, l1, l2 *Layer) (float64, bool) {
+	if cfg.ObserverLatitude == 0.0 && cfg.ObserverLongitude == 0.0 {
+		return 0.0, false
+	} else if l1.CameraTime.IsZero() || l2.CameraTime.IsZero() {
+		return 0.0, false
+	}
+
+	offset := time.Duration(cfg.CameraUTCOffsetHours * float64(time.Hour))
+	q1 := SunParallacticAngle(l1.CameraTime.Add(-1*offset), cfg.ObserverLatitude, cfg.ObserverLongitude)
+	q2 := SunParallacticAngle(l2.CameraTime.Add(-1*offset), cfg.ObserverLatitude, cfg.ObserverLongitude)
+
+	// The sky in l2 is rotated clockwise by (q2-q1), relative to l1;
+	// rotate it back.
+	rot := math.Mod(q1 - q2 + 540.0, 360.0) - 180.0
+	return rot, true
 }
 
 // AlignLayerFine tries a wide range of possible finetune xforms in
 // parallel, to find out which one fits best (i.e. has lowest error
-// metric).
-func AlignLayerFine(cfg Config, l1, l2 *Layer, baseXform AlignmentTransform) AlignmentTransform {
+// metric). It searches coarse-to-fine over image pyramids; a wide
+// search on the smallest images, then narrower & narrower searches at
+// each bigger level, so only a few candidates ever get scored at full
+// resolution.
+func AlignLayerFine(cfg Config, l1, l2 *Layer, baseXform AlignmentTransform) (AlignmentTransform, error) {
 	// The difference in radii found in the images; we start off by
 	// exploring x2 this amount. We can't need more than that, as the
 	// lunarlimbs need to line up.
-	radDelta := math.Abs(float64(l1.LunarLimb.Radius()) - float64(l2.LunarLimb.Radius()))
+	radDelta := math.Abs(l1.LunarLimb.PreciseRadius() - l2.LunarLimb.PreciseRadius())
 	if radDelta < 2.0 { radDelta = 2.0 }
-	
-	// Step 0. We start with a translation that superimposes the centre of the lunarlimbs.
+
+	// Keep halving until the images are getting too small to be useful
+	nLevels := 1
+	for nLevels < 5 && cfg.InputArea.Dx() >> uint(nLevels) >= 64 && cfg.InputArea.Dy() >> uint(nLevels) >= 64 {
+		nLevels++
+	}
+
+	// This is the illuminance at max over the two images (that have diff exposures)
+	evMax := l1.ExposureValue
+	if l2.IlluminanceAtMaxExposure > evMax.IlluminanceAtMaxExposure {
+		evMax = l2.ExposureValue
+	}
+
+	// The later layer needs a margin around the input area, for the
+	// translations & rotations to pull pixels in from.
+	margin := int(radDelta + math.Abs(baseXform.TranslateByX) + math.Abs(baseXform.TranslateByY)) + 
+		int(0.1 * float64(cfg.InputArea.Dx() + cfg.InputArea.Dy())) + 8
+	l2Area := cfg.InputArea.Inset(-1 * margin).Intersect(l2.LoadedImage.Bounds())
+
+	p1 := newLumPyramid(cfg, l1.Image, l1.ExposureValue, evMax, cfg.InputArea, nLevels)
+	p2 := newLumPyramid(cfg, l2.LoadedImage, l2.ExposureValue, evMax, l2Area, nLevels)
+
+	switch cfg.AlignRefine {
+	case "grid", "neldermead":
+	default:
+		return baseXform, fmt.Errorf("no AlignRefine strategy named %q", cfg.AlignRefine)
+	}
+	metric, err := cfg.GetAlignmentMetric()
+	if err != nil {
+		return baseXform, err
+	}
+
 	best := baseXform
-	width, step := 0.0, 0.0
 	xforms := []AlignmentTransform{}
+	nScored := 0
 
-	log.Printf("Align finetune:\n")
+	log.Printf("Align finetune (%d levels):\n", nLevels)
 	log.Printf(" -- orig  : %s\n", baseXform)
 
-	// Step 1. Try various whole-pixel translations. We pick an area to
-	// look in that's based on the difference in lunar radii in the
-	// images; more or less, these need to line up, so we don't need to
-	// explore any further.
-	width = radDelta
-	step = 1.0
-	xforms = xforms[:0]
-	for x:=-1*width; x<=width; x += step {
-		for y:=-1*width; y<=width; y += step {
-			xform := best
-			xform.TranslateByX += x
-			xform.TranslateByY += y
-			xforms = append(xforms, xform)
+	// Translations and rotations start wide, and then at each level we
+	// search +/- one step from the previous level, in half steps.
+	coarsest := nLevels - 1
+	width    := math.Max(radDelta, float64(int(1) << uint(coarsest)))
+	step     := float64(int(1) << uint(coarsest)) / 2.0
+	rotWidth := 5.0
+	rotStep  := 1.0
+
+	for level:=coarsest; level>=0; level-- {
+		score := func(xform AlignmentTransform) float64 { return p1.Diff(p2, level, xform, metric) }
+
+		// At full res, instead of the fixed grids, we can let an
+		// optimizer find the best transform.
+		if level == 0 && cfg.AlignRefine == "neldermead" {
+			best = refineNelderMead(cfg, p1, p2, metric, best)
+			break
 		}
-	}
-	best = scoreXFormsConcurrently(cfg, l1, l2, xforms, "pass1a")
 
-	// Step 2. In a much smaller area, explore fractional pixel
-	// translations. This relies on Catmull Rom interpolation.
-	width = 2.0
-	step = 0.10
-	xforms = xforms[:0]
-	for x:=-1*width; x<=width; x += step {
-		for y:=-1*width; y<=width; y += step {
+		// Pass A. Try translations.
+		xforms = xforms[:0]
+		for x:=-1*width; x<=width+1e-9; x += step {
+			for y:=-1*width; y<=width+1e-9; y += step {
+				xform := best
+				xform.TranslateByX += x
+				xform.TranslateByY += y
+				xforms = append(xforms, xform)
+			}
+		}
+		best = scoreXFormsConcurrently(xforms, fmt.Sprintf("level%d-translate", level), score)
+		nScored += len(xforms)
+
+		// Pass B. Now we think we have the images centred on each other,
+		// try some rotations. (This will only be useful if the images
+		// were separated by quite a lot of time)
+		xforms = xforms[:0]
+		for theta := -1.0*rotWidth; theta <= rotWidth+1e-9; theta += rotStep {
 			xform := best
-			xform.TranslateByX += x
-			xform.TranslateByY += y
+			// Note - the rotation center is not really well defined here :/
+			xform.RotateByDeg += theta
 			xforms = append(xforms, xform)
 		}
+		best = scoreXFormsConcurrently(xforms, fmt.Sprintf("level%d-rotate", level), score)
+		nScored += len(xforms)
+
+		width, step       = step, step / 2.0
+		rotWidth, rotStep = rotStep, rotStep / 2.0
+		if level == 1 {
+			// The final, full-res level gets sub-pixel steps.
+			width, step = 0.5, 0.1
+			rotStep     = math.Min(rotStep, 0.05)
+		}
+	}
+
+	if math.Abs(best.RotateByDeg) < 0.0001 { best.RotateByDeg = 0.0 }
+
+	// One last full-res check, so the error metric matches the other strategies
+	if best.ErrorMetric, err = ImgDiff(cfg, l1, l2, "final", best); err != nil {
+		return baseXform, err
 	}
-	best = scoreXFormsConcurrently(cfg, l1, l2, xforms, "pass1b")
 
-	// Step 3. Now we think we have the images centred on each other,
-	// try some coarse rotations. (This will only be useful if the
-	// images were separated by quite a lot of time)
-	rotWidth := 10.0
-	rotStep  := 1.0
-	xforms = xforms[:0]
-	for theta := -1.0*(rotWidth/2.0); theta < rotWidth/2.0; theta += rotStep {
-		xform := best
-		// Note - the rotation center is not really well defined here :/
-		xform.RotateByDeg = theta
-		xforms = append(xforms, xform)
-	}
-	best = scoreXFormsConcurrently(cfg, l1, l2, xforms, "pass2a")
-
-	// Step 4. Try a smaller amount of fine-grained rotations.
-	rotWidth = 2.0 // should be 10
-	rotStep  = 0.05
-	xforms = xforms[:0]
-	for theta := -1.0*(rotWidth/2.0); theta < rotWidth/2.0; theta += rotStep {
-		xform := best
-		// Note - the rotation center is not really well defined here
-		xform.RotateByDeg += theta
-		xforms = append(xforms, xform)
-	}
-	best = scoreXFormsConcurrently(cfg, l1, l2, xforms, "pass2b")
-
-	if best.RotateByDeg < 0.0001 { best.RotateByDeg = 0.0 }
-	
 	log.Printf("Align finetune: orig  %s\n", baseXform)
-	log.Printf("Align finetune: final %s\n", best)
-	return best
+	log.Printf("Align finetune: final %s (%d candidates scored)\n", best, nScored)
+	return best, nil
 }
 
 
 type fineTuneJob struct {
 	// Inputs for the job
-	C           Config
-	L1         *Layer
-	L2         *Layer
 	Name        string
 	XForm       AlignmentTransform
 
@@ -193,9 +299,9 @@ type fineTuneJob struct {
 }
 
 // ScoreXFormsConcurrently uses a pool of goroutines to compute the
-// error metrics for each of the proposed transform, and return the
-// one with the lowest error.
-func scoreXFormsConcurrently(cfg Config, l1, l2 *Layer, xforms []AlignmentTransform, name string) AlignmentTransform {
+// error metrics (via `score`) for each of the proposed transform, and
+// return the one with the lowest error.
+func scoreXFormsConcurrently(xforms []AlignmentTransform, name string, score func(AlignmentTransform) float64) AlignmentTransform {
 	var wg sync.WaitGroup
 	jobsChan    := make(chan fineTuneJob, len(xforms))
 	resultsChan := make(chan fineTuneJob, len(xforms))
@@ -207,7 +313,7 @@ func scoreXFormsConcurrently(cfg Config, l1, l2 *Layer, xforms []AlignmentTransf
 
 		go func() {
 			for job := range jobsChan {
-				job.ErrorMetric = ImgDiff(job.C, job.L1, job.L2, job.Name, job.XForm)
+				job.ErrorMetric = score(job.XForm)
 				resultsChan<- job
 				// log.Printf(" >> finetune [%s], xform %s, err: %6.0f\n", job.Name, job.XForm, job.ErrorMetric)
 			}
@@ -217,7 +323,7 @@ func scoreXFormsConcurrently(cfg Config, l1, l2 *Layer, xforms []AlignmentTransf
 	
 	// Feed in jobs
 	for i, xform := range xforms {
-		job := fineTuneJob{cfg, l1, l2, fmt.Sprintf("%s-%03d", name, i), xform, 0.0}
+		job := fineTuneJob{fmt.Sprintf("%s-%03d", name, i), xform, 0.0}
 		jobsChan<- job
 	}
 
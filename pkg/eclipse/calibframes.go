@@ -0,0 +1,328 @@
+package eclipse
+
+import(
+	"fmt"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/abworrall/eclipse-hdr/pkg/emath"
+)
+
+// CalibrationFrames holds the dark, bias and flat frames, that we use
+// to clean up the light frames (the Layers) before doing anything
+// else with them.
+//
+// They are found by putting them in subdirectories called `darks`,
+// `biases` and `flats` (or by listing them in the config file).
+type CalibrationFrames struct {
+	Darks  []Layer  // Lens cap on, same shutter speed & ISO as the light frames
+	Biases []Layer  // Lens cap on, fastest shutter speed
+	Flats  []Layer  // Evenly illuminated field, e.g. the sky at dusk through a white t-shirt
+}
+
+type calibrationKind int
+const(
+	notCalibration calibrationKind = iota
+	darkFrame
+	biasFrame
+	flatFrame
+)
+
+// calibrationKindForDir decides if a directory contains calibration frames, based on its name.
+func calibrationKindForDir(dir string) calibrationKind {
+	switch strings.ToLower(filepath.Base(dir)) {
+	case "dark", "darks":                return darkFrame
+	case "bias", "biases":               return biasFrame
+	case "flat", "flats":                return flatFrame
+	}
+	return notCalibration
+}
+
+func (cf CalibrationFrames)IsEmpty() bool {
+	return len(cf.Darks) == 0 && len(cf.Biases) == 0 && len(cf.Flats) == 0
+}
+
+func (cf CalibrationFrames)String() string {
+	return fmt.Sprintf("%d darks, %d biases, %d flats", len(cf.Darks), len(cf.Biases), len(cf.Flats))
+}
+
+// loadCalibrationFrames loads all the images in (or below) `path`
+// as calibration frames of the given kind.
+func (fi *FusedImage)loadCalibrationFrames(kind calibrationKind, path string) error {
+	filenames, err := listImageFiles(path)
+	if err != nil {
+		return err
+	}
+
+	for _, filename := range filenames {
+		l, err := loadImage(filename)
+		if err != nil {
+			return err
+		}
+
+		switch kind {
+		case darkFrame: fi.Calibration.Darks  = append(fi.Calibration.Darks, l)
+		case biasFrame: fi.Calibration.Biases = append(fi.Calibration.Biases, l)
+		case flatFrame: fi.Calibration.Flats  = append(fi.Calibration.Flats, l)
+		}
+	}
+
+	return nil
+}
+
+func listImageFiles(path string) ([]string, error) {
+	item, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("load %s: %v", path, err)
+	} else if !item.IsDir() {
+		return []string{path}, nil
+	}
+
+	contents, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, fmt.Errorf("readdir %s: %v", path, err)
+	}
+
+	filenames := []string{}
+	for _, content := range contents {
+		name := filepath.Join(path, content.Name())
+		if content.IsDir() {
+			more, err := listImageFiles(name)
+			if err != nil {
+				return nil, err
+			}
+			filenames = append(filenames, more...)
+		} else if ext := strings.ToLower(filepath.Ext(name)); ext == ".dng" || ext == ".tif" {
+			filenames = append(filenames, name)
+		}
+	}
+	return filenames, nil
+}
+
+// ApplyCalibrationFrames median-combines the calibration frames into
+// master frames, and then uses them to correct each Layer's
+// LoadedImage:
+//
+//   light' = (light - dark) / normalized(flat - bias)
+//
+// where the dark is the master dark with the same shutter speed and
+// ISO as the light frame; if there isn't one, the master bias is used
+// instead.
+//
+// It needs the layers' white levels, and the final ClipFraction, as
+// samples that were clipped in the photo are kept clipped (see
+// calibrateImage); so Align calls it, rather than LoadFilesAndDirs.
+func (fi *FusedImage)ApplyCalibrationFrames() error {
+	if fi.Calibration.IsEmpty() {
+		return nil
+	}
+
+	log.Printf("Building master calibration frames from %s\n", fi.Calibration)
+
+	masterBias, err := masterFrame(fi.Calibration.Biases)
+	if err != nil {
+		return fmt.Errorf("master bias: %v", err)
+	}
+
+	// Group the darks by exposure, and make a master for each
+	darkGroups := [][]Layer{}
+	for _, dark := range fi.Calibration.Darks {
+		found := false
+		for i := range darkGroups {
+			if sameDarkExposure(darkGroups[i][0].ExposureValue, dark.ExposureValue) {
+				darkGroups[i] = append(darkGroups[i], dark)
+				found = true
+				break
+			}
+		}
+		if !found {
+			darkGroups = append(darkGroups, []Layer{dark})
+		}
+	}
+	masterDarks := []Layer{}
+	for _, group := range darkGroups {
+		master, err := masterFrame(group)
+		if err != nil {
+			return fmt.Errorf("master dark: %v", err)
+		}
+		masterDarks = append(masterDarks, Layer{ExposureValue: group[0].ExposureValue, LoadedImage: master})
+	}
+
+	findDark := func(ev ExposureValue) image.Image {
+		for _, dark := range masterDarks {
+			if sameDarkExposure(dark.ExposureValue, ev) {
+				return dark.LoadedImage
+			}
+		}
+		if masterBias != nil {
+			return masterBias
+		}
+		return nil
+	}
+
+	var normFlat []emath.FloatGrid
+	if len(fi.Calibration.Flats) > 0 {
+		masterFlat, err := masterFrame(fi.Calibration.Flats)
+		if err != nil {
+			return fmt.Errorf("master flat: %v", err)
+		}
+		normFlat = normalizeFlat(masterFlat, findDark(fi.Calibration.Flats[0].ExposureValue))
+	}
+
+	for i := range fi.Layers {
+		l := &fi.Layers[i]
+		dark := findDark(l.ExposureValue)
+		if dark != nil && dark.Bounds() != l.LoadedImage.Bounds() {
+			return fmt.Errorf("%s: dark/bias frame has bounds %s, wanted %s", l.Filename(), dark.Bounds(), l.LoadedImage.Bounds())
+		}
+		if normFlat != nil && (normFlat[0].Dx() != l.LoadedImage.Bounds().Dx() || normFlat[0].Dy() != l.LoadedImage.Bounds().Dy()) {
+			return fmt.Errorf("%s: flat frame has different size", l.Filename())
+		}
+
+		clipLevel := emath.Vec3{}
+		for ch:=0; ch<3; ch++ {
+			clipLevel[ch] = l.WhiteLevel[ch] * fi.Config.ClipFraction
+		}
+		l.LoadedImage = calibrateImage(l.LoadedImage, dark, normFlat, clipLevel)
+		l.Image = l.LoadedImage
+		log.Printf("Calibrated %s (dark:%v, flat:%v)\n", l.Filename(), dark != nil, normFlat != nil)
+	}
+
+	return nil
+}
+
+// Darks only match if they had the same exposure time and ISO (aperture doesn't matter).
+func sameDarkExposure(ev1, ev2 ExposureValue) bool {
+	t1, t2 := ev1.ShutterSpeed.Float64(), ev2.ShutterSpeed.Float64()
+	return ev1.ISO == ev2.ISO && math.Abs(t1/t2 - 1.0) < 0.01
+}
+
+// masterFrame median-combines the frames, one channel at a time. It
+// returns nil if there are no frames.
+func masterFrame(frames []Layer) (*image.RGBA64, error) {
+	if len(frames) == 0 {
+		return nil, nil
+	}
+
+	bounds := frames[0].LoadedImage.Bounds()
+	for _, f := range frames[1:] {
+		if f.LoadedImage.Bounds() != bounds {
+			return nil, fmt.Errorf("%s has bounds %s, wanted %s", f.Filename(), f.LoadedImage.Bounds(), bounds)
+		}
+	}
+
+	master := image.NewRGBA64(bounds)
+	r := make([]uint32, len(frames))
+	g := make([]uint32, len(frames))
+	b := make([]uint32, len(frames))
+	median := func(vals []uint32) uint16 {
+		sort.Slice(vals, func(i, j int) bool { return vals[i] < vals[j] })
+		return uint16(vals[len(vals)/2])
+	}
+
+	for x:=bounds.Min.X; x<bounds.Max.X; x++ {
+		for y:=bounds.Min.Y; y<bounds.Max.Y; y++ {
+			for i, f := range frames {
+				r[i], g[i], b[i], _ = f.LoadedImage.At(x, y).RGBA()
+			}
+			master.SetRGBA64(x, y, color.RGBA64{median(r), median(g), median(b), 0xFFFF})
+		}
+	}
+
+	return master, nil
+}
+
+// normalizeFlat subtracts the dark (or bias) from the flat, and then
+// scales each channel so that its mean is 1.0.
+func normalizeFlat(flat, dark image.Image) []emath.FloatGrid {
+	bounds := flat.Bounds()
+	grids  := []emath.FloatGrid{
+		emath.NewFloatGrid(bounds.Dx(), bounds.Dy()),
+		emath.NewFloatGrid(bounds.Dx(), bounds.Dy()),
+		emath.NewFloatGrid(bounds.Dx(), bounds.Dy()),
+	}
+	sums := [3]float64{}
+
+	for x:=bounds.Min.X; x<bounds.Max.X; x++ {
+		for y:=bounds.Min.Y; y<bounds.Max.Y; y++ {
+			vals := subtractDark(flat.At(x, y), dark, x, y)
+			for ch:=0; ch<3; ch++ {
+				grids[ch].Set(x-bounds.Min.X, y-bounds.Min.Y, vals[ch])
+				sums[ch] += vals[ch]
+			}
+		}
+	}
+
+	n := float64(bounds.Dx() * bounds.Dy())
+	for ch:=0; ch<3; ch++ {
+		mean := sums[ch] / n
+		for x:=0; x<bounds.Dx(); x++ {
+			for y:=0; y<bounds.Dy(); y++ {
+				val := grids[ch].Get(x, y) / mean
+				if val < 0.1 { val = 0.1 } // don't blow up the dead corners
+				grids[ch].Set(x, y, val)
+			}
+		}
+	}
+
+	return grids
+}
+
+// subtractDark returns the three channels, as float values in the
+// range [0, 0xFFFF], with the dark subtracted (if there is one).
+func subtractDark(c color.Color, dark image.Image, x, y int) [3]float64 {
+	r, g, b, _ := c.RGBA()
+	vals := [3]float64{float64(r), float64(g), float64(b)}
+
+	if dark != nil {
+		dr, dg, db, _ := dark.At(x, y).RGBA()
+		vals[0] -= float64(dr)
+		vals[1] -= float64(dg)
+		vals[2] -= float64(db)
+	}
+
+	for ch:=0; ch<3; ch++ {
+		if vals[ch] < 0.0 { vals[ch] = 0.0 }
+	}
+	return vals
+}
+
+// calibrateImage applies the dark and the flat to the light frame.
+// Any channel that was at or above `clipLevel` (in [0,1]) in the
+// photo is set to full scale, rather than calibrated; otherwise the
+// dark subtraction (and a flat above 1.0, in the middle of the frame)
+// would pull it under the white level, and Layer.IsClipped would let
+// the fusers use it.
+func calibrateImage(light, dark image.Image, normFlat []emath.FloatGrid, clipLevel emath.Vec3) image.Image {
+	bounds := light.Bounds()
+	out    := image.NewRGBA64(bounds)
+
+	for x:=bounds.Min.X; x<bounds.Max.X; x++ {
+		for y:=bounds.Min.Y; y<bounds.Max.Y; y++ {
+			c          := light.At(x, y)
+			r, g, b, _ := c.RGBA()
+			raw        := [3]uint32{r, g, b}
+			vals       := subtractDark(c, dark, x, y)
+			if normFlat != nil {
+				for ch:=0; ch<3; ch++ {
+					vals[ch] /= normFlat[ch].Get(x-bounds.Min.X, y-bounds.Min.Y)
+				}
+			}
+			for ch:=0; ch<3; ch++ {
+				if vals[ch] > 0xFFFF || float64(raw[ch]) / float64(0xFFFF) >= clipLevel[ch] {
+					vals[ch] = 0xFFFF
+				}
+			}
+			out.SetRGBA64(x, y, color.RGBA64{uint16(vals[0]), uint16(vals[1]), uint16(vals[2]), 0xFFFF})
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,107 @@
+package eclipse
+
+import(
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/abworrall/eclipse-hdr/pkg/ecolor"
+)
+
+// An ExposureCalibration records how much brighter one layer really
+// was than the next, compared to what the EXIF data says. Nominal
+// shutter speeds can be off by several percent, which shows up as
+// brightness seams in the fused image.
+type ExposureCalibration struct {
+	Name          string
+	NominalRatio  float64 // IlluminanceAtMaxExposure ratio from the EXIF data
+	MeasuredRatio float64 // The ratio we measured from the pixels
+	NumPixels     int     // How many pixels were well exposed in both layers
+}
+
+func (ec ExposureCalibration)String() string {
+	return fmt.Sprintf("Calib[%s nominal %7.4f, measured %7.4f (%+.1f%%), %d pixels]",
+		ec.Name, ec.NominalRatio, ec.MeasuredRatio, 100.0 * (ec.MeasuredRatio/ec.NominalRatio - 1.0),
+		ec.NumPixels)
+}
+
+// CalibrateExposures compares each adjacent pair of (aligned) layers,
+// using the pixels that are well exposed in both, to measure the true
+// gain ratio between them. The base layer keeps its nominal
+// IlluminanceAtMaxExposure; each following layer is then set relative
+// to the one before it, using the measured ratio.
+//
+// If DoExposureCalibration is false, it will reuse any calibrations
+// that were loaded from the config file.
+func (fi *FusedImage)CalibrateExposures() {
+	for i:=1; i<len(fi.Layers); i++ {
+		l1, l2 := &fi.Layers[i-1], &fi.Layers[i]
+		name := fmt.Sprintf("%s-%s", l1.Filename(), l2.Filename())
+
+		calib, exists := fi.Config.ExposureCalibrations[name]
+		if fi.Config.DoExposureCalibration {
+			calib = measureExposureRatio(fi.Config, l1, l2)
+			calib.Name = name
+			fi.Config.ExposureCalibrations[name] = calib
+			log.Printf("Exposure calibration: %s\n", calib)
+
+		} else if exists {
+			log.Printf("Using exposure calibration from config file: %s\n", calib)
+
+		} else {
+			continue
+		}
+
+		if calib.MeasuredRatio <= 0.0 {
+			log.Printf("Exposure calibration for %s had no usable pixels, keeping nominal EV\n", name)
+			continue
+		}
+
+		l2.IlluminanceAtMaxExposure = l1.IlluminanceAtMaxExposure * calib.MeasuredRatio
+	}
+
+	if fi.Config.DoExposureCalibration {
+		log.Printf("Exposure calibrations:-\n\n%s\n", fi.Config.AsYaml())
+	}
+}
+
+// measureExposureRatio returns the median, over all the pixels that
+// are well exposed in both layers, of how much brighter the pixel
+// is in l1 than in l2. Since l2 needed more illuminance to expose
+// fully, this should match the ratio of their IlluminanceAtMaxExposure.
+func measureExposureRatio(cfg Config, l1, l2 *Layer) ExposureCalibration {
+	bounds := cfg.InputArea
+	ratios := []float64{}
+
+	for x:= bounds.Min.X; x<bounds.Max.X; x++ {
+		for y:= bounds.Min.Y; y<bounds.Max.Y; y++ {
+			c1 := l1.Image.At(x, y)
+			c2 := l2.Image.At(x, y)
+			if exposureOf(c1) != wellExposed || exposureOf(c2) != wellExposed {
+				continue
+			}
+
+			// Linearize, but keep the values raw (i.e. not scaled by EV)
+			cn1 := ecolor.NewCameraNativeWithResponse(c1, 1.0, cfg.ResponseCurve)
+			cn2 := ecolor.NewCameraNativeWithResponse(c2, 1.0, cfg.ResponseCurve)
+			v1  := cn1.RGB.R + cn1.RGB.G + cn1.RGB.B
+			v2  := cn2.RGB.R + cn2.RGB.G + cn2.RGB.B
+			if v2 <= 0.0 {
+				continue
+			}
+			ratios = append(ratios, v1/v2)
+		}
+	}
+
+	calib := ExposureCalibration{
+		NominalRatio: l2.IlluminanceAtMaxExposure / l1.IlluminanceAtMaxExposure,
+		NumPixels:    len(ratios),
+	}
+
+	if len(ratios) > 0 {
+		sort.Float64s(ratios)
+		calib.MeasuredRatio = ratios[len(ratios)/2]
+	}
+
+	return calib
+}
@@ -1,10 +1,12 @@
 package eclipse
 
 import(
+	"fmt"
 	"image"
 	"log"
 	"gopkg.in/yaml.v2"
 
+	"github.com/abworrall/eclipse-hdr/pkg/ecolor"
 	"github.com/abworrall/eclipse-hdr/pkg/emath"
 )
 
@@ -13,23 +15,62 @@ type Config struct {
 	
 	ManualOverrideAsShotNeutral emath.Vec3   // A white/neutral color in camera native RGB space
 	ManualOverrideForwardMatrix emath.Mat3   // Maps white-balanced camera native RGB into XYZ(D50).
+	ResponseCurve               ecolor.ResponseCurve // Linearizes the input images; empty means they're already linear
+	WhiteLevels                 map[string]emath.Vec3 // Per camera model (or "default"), the level in (0,1] each channel clips at
+	ClipFraction                float64  // samples above this fraction of the white level count as clipped
+
+	DarkFrames                  []string // Files or dirs of calibration frames (or just use subdirs called darks/, biases/, flats/)
+	BiasFrames                  []string
+	FlatFrames                  []string
+
+	LimbFinder                  string   // how to find the lunar limb: floodfill (falls back to hough if it fails), or hough
+	LunarRadiusPix              float64  // roughly how big the moon is, for the hough limb finder; 0 means figure it out
+
+	ObserverLatitude            float64  // degrees, north is positive; if this and the longitude are both zero,
+	ObserverLongitude           float64  // degrees, east is positive;  we don't correct for field rotation
+	CameraUTCOffsetHours        float64  // the timezone the camera clock was set to, e.g. -5 for CDT
+	OrientNorth                 string   // rotate the output so north is up: celestial, solar, or "" to leave it as shot
+	CameraRollDeg               float64  // how far the camera was rolled clockwise from level (as seen from behind it)
 
 	DoEclipseAlignment          bool
+	ReferenceLayer              string   // which layer to align the others to: a filename, an EV, auto (best limb fit), or "" (the first)
 	DoFineTunedAlignment        bool
+	AlignStrategy               string   // how to finetune the alignment: phasecorr, fouriermellin, or bruteforce
+	AlignRefine                 string   // how bruteforce does its final sub-pixel pass: grid, or neldermead
+	AlignMetric                 string   // how to score alignments: mad, ncc, gradient, or mi
+	AlignRefineTolerance        float64  // neldermead stops when the error improves by less than this fraction ...
+	AlignRefineMaxIterations    int      // ... or after this many iterations
+	AlignRefineStallIterations  int      // ... or when it has gone this many iterations without improving
+	DoAlignmentCache            bool     // reuse finetuned alignments from (and save them to) a cache file next to the photos
+	DoResponseCurve             bool
+	DoExposureCalibration       bool
+	ResponseCurveSmoothness     float64
 	OutputWidthInSolarDiameters float64
 
 	Fuser                       string
 	Developer                   string
 	Tonemapper                  string
 	FuserLuminance              float64  // a var used by the fuser
+	FuserFeatherWidth           float64  // the feather fuser fades between layers over this range of luminance
+	StackSigmaClip              float64  // when stacking layers with the same exposure, reject samples this many std devs out
+	GhostThreshold              float64  // when fusing, reject a layer that is this far (as a fraction) from the others' median; 0 means don't
+	MertensContrastWeight       float64  // for exposure fusion, how much each layer's pixels are weighted by local contrast ...
+	MertensSaturationWeight     float64  // ... by color saturation ...
+	MertensExposednessWeight    float64  // ... and by how close to mid-gray they are
+
+	LarsonSekaninaAngleDeg      float64  // rotational shift for the Larson-Sekanina filter; 0 means don't run it
+	LarsonSekaninaRadialShift   float64  // radial shift, in pixels
+	LarsonSekaninaBlend         float64  // how strongly to blend the filter back into the HDR image
 
 	Alignments                  map[string]AlignmentTransform
+	ExposureCalibrations        map[string]ExposureCalibration
 
 	// Values we figure out elsewhere, and put here for access by rest of app
 	CameraWhite                 emath.Vec3       // From a DNG file Layer{}, or overrides
 	CameraToPCS                 emath.Mat3       // From a DNG file Layer{}, or overrides
 	InputArea                   image.Rectangle
 	OutputArea                  image.Rectangle
+	OutputRotationDeg           float64          // How far (clockwise) the output was rotated to put north up
 }
 
 func newConfigFromYaml(b []byte) (Config, error) {
@@ -41,7 +82,7 @@ func newConfigFromYaml(b []byte) (Config, error) {
 func (c Config)AsYaml() string {
 	b, err := yaml.Marshal(c)
 	if err != nil {
-		log.Fatal("Can't marshal config yaml: %v\n", err)
+		log.Fatalf("Can't marshal config yaml: %v\n", err)
 	}
 	return string(b)
 }
@@ -49,20 +90,97 @@ func (c Config)AsYaml() string {
 func NewConfig() Config {
 	return Config{
 		Alignments: map[string]AlignmentTransform{},
+		ExposureCalibrations: map[string]ExposureCalibration{},
+		ResponseCurveSmoothness: 50.0,
+		OutputWidthInSolarDiameters: 4.0,
+		Fuser: "mostexposed",
+		Developer: "dng",
+		Tonemapper: "all",
+		FuserLuminance: 0.8,
+		LarsonSekaninaBlend: 0.5,
+		DoEclipseAlignment: true,
+		StackSigmaClip: 2.0,
+		WhiteLevels: map[string]emath.Vec3{},
+		ClipFraction: 0.98,
+		FuserFeatherWidth: 0.1,
+		MertensContrastWeight: 1.0,
+		MertensSaturationWeight: 1.0,
+		MertensExposednessWeight: 1.0,
+		LimbFinder: "floodfill",
+		AlignStrategy: "phasecorr",
+		AlignRefine: "grid",
+		AlignMetric: "mad",
+		AlignRefineTolerance: 1e-5,
+		AlignRefineMaxIterations: 500,
+		AlignRefineStallIterations: 20,
+		DoAlignmentCache: true,
 	}
 }
 
+// Validate checks the names of the strategies that would otherwise
+// only be looked up part way through the processing, after all the
+// photos have been loaded (and maybe after a slow alignment).
+func (c Config)Validate() error {
+	switch c.LimbFinder {
+	case "floodfill", "hough", "":
+	default:
+		return fmt.Errorf("no LimbFinder strategy named %q", c.LimbFinder)
+	}
+
+	if _, err := c.GetFineAligner(); err != nil {
+		return err
+	}
+
+	switch c.AlignRefine {
+	case "grid", "neldermead":
+	default:
+		return fmt.Errorf("no AlignRefine strategy named %q", c.AlignRefine)
+	}
+
+	if _, err := c.GetAlignmentMetric(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
 func (c Config)GetFuser() PixelFunc {
 	switch c.Fuser {
 	case "mostexposed": return FuseByPickMostExposed
 	case "sector":      return FuseBySector
 	case "avg":         return FuseByAverage
+	case "weighted":    return FuseByWeightedAverage
+	case "feather":     return FuseByFeathering
 	default:
 		log.Fatalf("no Fuser strategy named '%s'", c.Fuser)
 		return nil
 	}
 }
 
+// A FineAligner refines the transform that maps l2 onto l1, starting from baseXform.
+type FineAligner func(cfg Config, l1, l2 *Layer, baseXform AlignmentTransform) (AlignmentTransform, error)
+
+func (c Config)GetFineAligner() (FineAligner, error) {
+	switch c.AlignStrategy {
+	case "phasecorr":     return AlignLayerPhaseCorrelation, nil
+	case "fouriermellin": return AlignLayerFourierMellin, nil
+	case "bruteforce":    return AlignLayerFine, nil
+	default:
+		return nil, fmt.Errorf("no AlignStrategy named %q", c.AlignStrategy)
+	}
+}
+
+func (c Config)GetAlignmentMetric() (AlignmentMetric, error) {
+	switch c.AlignMetric {
+	case "mad", "":  return madMetric{}, nil
+	case "ncc":      return nccMetric{}, nil
+	case "gradient": return gradientMetric{}, nil
+	case "mi":       return miMetric{Bins: 64}, nil
+	default:
+		return nil, fmt.Errorf("no AlignMetric named %q", c.AlignMetric)
+	}
+}
+
 func (c Config)GetDeveloper() PixelFunc {
 	switch c.Developer {
 	case "layer": return DevelopByLayer
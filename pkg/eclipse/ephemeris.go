@@ -0,0 +1,72 @@
+package eclipse
+
+import(
+	"math"
+	"time"
+)
+
+// Just enough of the sun's position to work out how the sky is
+// oriented in the photos. These are the low precision formulae from
+// the Astronomical Almanac, good to a hundredth of a degree or so.
+
+var j2000 = time.Date(2000, time.January, 1, 12, 0, 0, 0, time.UTC)
+
+func daysSinceJ2000(t time.Time) float64 {
+	return t.Sub(j2000).Hours() / 24.0
+}
+
+// sunEcliptic returns the sun's ecliptic longitude, and the obliquity
+// of the ecliptic, in radians, at time t.
+func sunEcliptic(t time.Time) (float64, float64) {
+	n       := daysSinceJ2000(t)
+	L       := 280.460 + 0.9856474*n                                         // mean longitude
+	g       := (357.528 + 0.9856003*n) * math.Pi / 180.0                     // mean anomaly
+	lambda  := (L + 1.915*math.Sin(g) + 0.020*math.Sin(2*g)) * math.Pi / 180.0 // ecliptic longitude
+	epsilon := (23.439 - 0.0000004*n) * math.Pi / 180.0                      // obliquity of the ecliptic
+	return lambda, epsilon
+}
+
+// sunRADec returns the sun's right ascension and declination, in
+// degrees, at time t.
+func sunRADec(t time.Time) (float64, float64) {
+	lambda, epsilon := sunEcliptic(t)
+	ra  := math.Atan2(math.Cos(epsilon)*math.Sin(lambda), math.Cos(lambda))
+	dec := math.Asin(math.Sin(epsilon)*math.Sin(lambda))
+	return ra * 180.0 / math.Pi, dec * 180.0 / math.Pi
+}
+
+// sunHourAngle returns the sun's local hour angle (degrees) at time t,
+// for an observer at the given longitude (east is positive).
+func sunHourAngle(t time.Time, lonDeg float64) float64 {
+	ra, _ := sunRADec(t)
+	gmst := 280.46061837 + 360.98564736629*daysSinceJ2000(t)
+	return math.Mod(gmst + lonDeg - ra, 360.0)
+}
+
+// SunParallacticAngle returns the angle (degrees) between the
+// direction to the zenith and the direction to the north celestial
+// pole, as seen at the sun. A camera on an alt-az mount (e.g. a
+// tripod) keeps the zenith fixed, so the sky in its photos rotates by
+// however much this changes.
+func SunParallacticAngle(t time.Time, latDeg, lonDeg float64) float64 {
+	_, dec := sunRADec(t)
+	H   := sunHourAngle(t, lonDeg) * math.Pi / 180.0
+	phi := latDeg * math.Pi / 180.0
+	d   := dec * math.Pi / 180.0
+	return math.Atan2(math.Sin(H), math.Tan(phi)*math.Cos(d) - math.Sin(d)*math.Cos(H)) * 180.0 / math.Pi
+}
+
+// SunPAngle returns the position angle (degrees, measured from
+// celestial north towards the east) of the sun's rotation axis, as per
+// Meeus, Astronomical Algorithms ch. 29.
+func SunPAngle(t time.Time) float64 {
+	jd := 2451545.0 + daysSinceJ2000(t)
+	lambda, epsilon := sunEcliptic(t)
+
+	I := 7.25 * math.Pi / 180.0                                       // inclination of the solar equator
+	K := (73.6667 + 1.3958333*(jd - 2396758.0)/36525.0) * math.Pi / 180.0 // longitude of its ascending node
+
+	x := math.Atan(-1.0 * math.Cos(lambda) * math.Tan(epsilon))
+	y := math.Atan(-1.0 * math.Cos(lambda - K) * math.Tan(I))
+	return (x + y) * 180.0 / math.Pi
+}
@@ -0,0 +1,115 @@
+package eclipse
+
+import(
+	"math"
+	"testing"
+	"time"
+)
+
+// Dallas, which was on the centerline of the 2024 eclipse.
+const testLat, testLon = 32.78, -96.80
+
+func TestSunRADec(t *testing.T) {
+	tests := []struct{
+		t        time.Time
+		ra, dec  float64
+	}{
+		{time.Date(2024, time.March, 20, 3, 6, 0, 0, time.UTC),    0.0,   0.0},    // equinox
+		{time.Date(2024, time.June, 20, 20, 51, 0, 0, time.UTC),  90.0,  23.435},  // solstice
+		{time.Date(2024, time.April, 8, 18, 42, 0, 0, time.UTC),  17.9,   7.60},   // 01h11.6m, +7d36m
+	}
+
+	for _, test := range tests {
+		ra, dec := sunRADec(test.t)
+		if math.Abs(ra - test.ra) > 0.05 || math.Abs(dec - test.dec) > 0.05 {
+			t.Errorf("%s: got ra=%.3f, dec=%.3f", test.t, ra, dec)
+		}
+	}
+}
+
+// The parallactic angle is negative while the sun is rising (east of
+// the meridian), and positive once it has transited; check it against
+// the other way of solving the same spherical triangle, via the sun's
+// altitude.
+func TestSunParallacticAngle(t *testing.T) {
+	tests := []struct{
+		hour, min int
+		sign      float64
+	}{
+		{14, 0,   -1},
+		{18, 0,   -1},
+		{18, 42,   0},
+		{19, 0,    1},
+		{23, 0,    1},
+	}
+
+	for _, test := range tests {
+		tm := time.Date(2024, time.April, 8, test.hour, test.min, 0, 0, time.UTC)
+		q := SunParallacticAngle(tm, testLat, testLon)
+
+		_, dec := sunRADec(tm)
+		H   := sunHourAngle(tm, testLon) * math.Pi / 180.0
+		phi := testLat * math.Pi / 180.0
+		d   := dec * math.Pi / 180.0
+		alt := math.Asin(math.Sin(phi)*math.Sin(d) + math.Cos(phi)*math.Cos(d)*math.Cos(H))
+		expected := math.Asin(math.Sin(H) * math.Cos(phi) / math.Cos(alt)) * 180.0 / math.Pi
+
+		if math.Abs(q - expected) > 0.01 {
+			t.Errorf("%s: got %.3f, expected %.3f", tm, q, expected)
+		}
+		if (test.sign == 0 && math.Abs(q) > 10.0) || q*test.sign < 0 {
+			t.Errorf("%s: got %.3f, wrong sign", tm, q)
+		}
+	}
+}
+
+func TestFieldRotation(t *testing.T) {
+	cfg := NewConfig()
+	cfg.ObserverLatitude     = testLat
+	cfg.ObserverLongitude    = testLon
+	cfg.CameraUTCOffsetHours = -5 // CDT; camera clocks run on local time
+
+	l1 := Layer{CameraTime: time.Date(2024, time.April, 8, 13, 0, 0, 0, time.UTC)}
+	l2 := Layer{CameraTime: time.Date(2024, time.April, 8, 14, 0, 0, 0, time.UTC)}
+
+	q1 := SunParallacticAngle(time.Date(2024, time.April, 8, 18, 0, 0, 0, time.UTC), testLat, testLon)
+	q2 := SunParallacticAngle(time.Date(2024, time.April, 8, 19, 0, 0, 0, time.UTC), testLat, testLon)
+
+	// Around transit the parallactic angle increases, so the later
+	// layer needs rotating back the other way.
+	if rot, ok := FieldRotation(cfg, &l1, &l2); !ok || math.Abs(rot - (q1-q2)) > 1e-9 || rot >= 0 {
+		t.Errorf("field rotation: got %.3f (ok=%v), expected %.3f", rot, ok, q1-q2)
+	}
+	if rot, ok := FieldRotation(cfg, &l2, &l1); !ok || math.Abs(rot - (q2-q1)) > 1e-9 {
+		t.Errorf("reverse field rotation: got %.3f (ok=%v), expected %.3f", rot, ok, q2-q1)
+	}
+
+	noSite := NewConfig()
+	if _, ok := FieldRotation(noSite, &l1, &l2); ok {
+		t.Errorf("field rotation without a site: got ok")
+	}
+	if _, ok := FieldRotation(cfg, &l1, &Layer{}); ok {
+		t.Errorf("field rotation without a timestamp: got ok")
+	}
+}
+
+// The sun's axis tips furthest west of north (-26deg) in early April,
+// and furthest east (+26deg) in early October; it is upright early in
+// January and July.
+func TestSunPAngle(t *testing.T) {
+	tests := []struct{
+		t time.Time
+		p float64
+	}{
+		{time.Date(2024, time.April, 8, 18, 42, 0, 0, time.UTC),  -26.23},
+		{time.Date(1992, time.October, 13, 0, 0, 0, 0, time.UTC),  26.27}, // Meeus, example 29.a
+		{time.Date(2024, time.January, 5, 0, 0, 0, 0, time.UTC),    0.37},
+		{time.Date(2024, time.July, 7, 0, 0, 0, 0, time.UTC),       0.23},
+	}
+
+	for _, test := range tests {
+		if p := SunPAngle(test.t); math.Abs(p - test.p) > 0.1 {
+			t.Errorf("%s: got %.3f, expected %.2f", test.t, p, test.p)
+		}
+	}
+}
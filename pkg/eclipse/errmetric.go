@@ -0,0 +1,177 @@
+package eclipse
+
+import(
+	"math"
+
+	"github.com/abworrall/eclipse-hdr/pkg/emath"
+)
+
+// An AlignmentMetric scores how badly two grids of luminance values
+// agree; the lower the score, the better the alignment. The grids are
+// the same size, and any NaN values (pixels that weren't well exposed)
+// are ignored.
+//
+// Scores from different metrics can't be compared with each other.
+type AlignmentMetric interface {
+	Score(g1, g2 *emath.FloatGrid) float64
+}
+
+// madMetric is the mean absolute difference; it relies on the EV
+// normalization being spot on.
+type madMetric struct{}
+
+func (madMetric)Score(g1, g2 *emath.FloatGrid) float64 {
+	totErr, nErr := 0.0, 0
+	for x:=0; x<g1.Dx(); x++ {
+		for y:=0; y<g1.Dy(); y++ {
+			Y1, Y2 := g1.Get(x, y), g2.Get(x, y)
+			if math.IsNaN(Y1) || math.IsNaN(Y2) {
+				continue
+			}
+			totErr += math.Abs(Y1 - Y2)
+			nErr++
+		}
+	}
+	if nErr == 0 {
+		return math.MaxFloat64
+	}
+	return totErr * 10000000.0 / float64(nErr)
+}
+
+// nccMetric is based on normalized cross-correlation, which doesn't
+// care if one image is brighter (or has a constant offset, e.g. from
+// differing earthshine) than the other.
+type nccMetric struct{}
+
+func (nccMetric)Score(g1, g2 *emath.FloatGrid) float64 {
+	return (1.0 - ncc(g1, g2)) * 100000.0
+}
+
+// gradientMetric correlates the gradient magnitudes of the images, so
+// it only looks at edges & structure (e.g. streamers), not at smooth
+// changes in brightness.
+type gradientMetric struct{}
+
+func (gradientMetric)Score(g1, g2 *emath.FloatGrid) float64 {
+	grad1 := gradientMagnitude(g1)
+	grad2 := gradientMagnitude(g2)
+	return (1.0 - ncc(&grad1, &grad2)) * 100000.0
+}
+
+// miMetric is based on the normalized mutual information of the log
+// luminances; it only needs there to be some consistent relationship
+// between the pixel values in the two images, not a linear one.
+type miMetric struct{
+	Bins int
+}
+
+func (m miMetric)Score(g1, g2 *emath.FloatGrid) float64 {
+	// Find the range of (log) values in each image
+	min1, max1 := math.Inf(1), math.Inf(-1)
+	min2, max2 := math.Inf(1), math.Inf(-1)
+	for x:=0; x<g1.Dx(); x++ {
+		for y:=0; y<g1.Dy(); y++ {
+			Y1, Y2 := g1.Get(x, y), g2.Get(x, y)
+			if !(Y1 > 0.0 && Y2 > 0.0) { // also skips NaNs
+				continue
+			}
+			min1, max1 = math.Min(min1, math.Log(Y1)), math.Max(max1, math.Log(Y1))
+			min2, max2 = math.Min(min2, math.Log(Y2)), math.Max(max2, math.Log(Y2))
+		}
+	}
+	if math.IsInf(min1, 1) || max1 <= min1 || max2 <= min2 {
+		return math.MaxFloat64
+	}
+
+	bin := func(v, min, max float64) int {
+		b := int(float64(m.Bins) * (math.Log(v) - min) / (max - min))
+		if b >= m.Bins { b = m.Bins - 1 }
+		return b
+	}
+
+	joint := make([]float64, m.Bins*m.Bins)
+	n     := 0.0
+	for x:=0; x<g1.Dx(); x++ {
+		for y:=0; y<g1.Dy(); y++ {
+			Y1, Y2 := g1.Get(x, y), g2.Get(x, y)
+			if !(Y1 > 0.0 && Y2 > 0.0) {
+				continue
+			}
+			joint[bin(Y1, min1, max1)*m.Bins + bin(Y2, min2, max2)]++
+			n++
+		}
+	}
+
+	h1 := make([]float64, m.Bins)
+	h2 := make([]float64, m.Bins)
+	for i:=0; i<m.Bins; i++ {
+		for j:=0; j<m.Bins; j++ {
+			h1[i] += joint[i*m.Bins + j]
+			h2[j] += joint[i*m.Bins + j]
+		}
+	}
+
+	entropy := func(hist []float64) float64 {
+		e := 0.0
+		for _, count := range hist {
+			if count > 0.0 {
+				p := count / n
+				e -= p * math.Log(p)
+			}
+		}
+		return e
+	}
+
+	// NMI = (H1+H2)/H12 is 1.0 for unrelated images, and 2.0 for a perfect match
+	nmi := (entropy(h1) + entropy(h2)) / entropy(joint)
+	return (2.0 - nmi) * 100000.0
+}
+
+// ncc returns the normalized cross-correlation of the two grids,
+// skipping NaNs; 1.0 is a perfect match.
+func ncc(g1, g2 *emath.FloatGrid) float64 {
+	s1, s2, s11, s22, s12, n := 0.0, 0.0, 0.0, 0.0, 0.0, 0.0
+	for x:=0; x<g1.Dx(); x++ {
+		for y:=0; y<g1.Dy(); y++ {
+			v1, v2 := g1.Get(x, y), g2.Get(x, y)
+			if math.IsNaN(v1) || math.IsNaN(v2) {
+				continue
+			}
+			s1  += v1
+			s2  += v2
+			s11 += v1*v1
+			s22 += v2*v2
+			s12 += v1*v2
+			n++
+		}
+	}
+	if n < 2 {
+		return 0.0
+	}
+
+	cov  := s12/n - (s1/n)*(s2/n)
+	var1 := s11/n - (s1/n)*(s1/n)
+	var2 := s22/n - (s2/n)*(s2/n)
+	if var1 <= 0.0 || var2 <= 0.0 {
+		return 0.0
+	}
+	return cov / math.Sqrt(var1*var2)
+}
+
+// gradientMagnitude uses forward differences; if any of the pixels
+// involved are NaN, so is the result.
+func gradientMagnitude(g *emath.FloatGrid) emath.FloatGrid {
+	out := g.NewFromThis()
+	for x:=0; x<g.Dx(); x++ {
+		for y:=0; y<g.Dy(); y++ {
+			if x == g.Dx()-1 || y == g.Dy()-1 {
+				out.Set(x, y, math.NaN())
+				continue
+			}
+			dx := g.Get(x+1, y) - g.Get(x, y)
+			dy := g.Get(x, y+1) - g.Get(x, y)
+			out.Set(x, y, math.Hypot(dx, dy))
+		}
+	}
+	return out
+}
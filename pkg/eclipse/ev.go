@@ -2,137 +2,69 @@ package eclipse
 
 import (
 	"fmt"
+	"math"
 )
 
 type rat64 [2]int64
 
+func (r rat64)Float64() float64 { return float64(r[0]) / float64(r[1]) }
+
 // An ExposureValue details how the photograph was exposed, and allows
 // us to figure out how much physical illumination (cd/m^2) was
 // hitting the sensor, given a pixel color from the image.
 //
-// This type figures out an 'EV' value, basicaly how many 'stops'; but
-// it rounds off the shutterspeed & aperture-fnumber to the values
-// that are "whole" stops.
+// This type figures out an 'EV' value, basicaly how many 'stops'. It
+// is computed directly from the aperture, shutter speed and ISO, so
+// it needn't be a whole number; third-stop settings such as f/6.3 or
+// ISO 640 are handled correctly.
 type ExposureValue struct {
-	ISO                        int    // 100, 800, etc.
-	ApertureX10                int    // f/5.6 is the integer 56.
-	ShutterSpeed               rat64  // 1/500, 1/1000, etc.
-	EV                         int    // The final EV value - https://en.wikipedia.org/wiki/Exposure_value
+	ISO                        int      // 100, 800, 640, etc.
+	FNumber                    float64  // f/5.6 is 5.6
+	ShutterSpeed               rat64    // 1/500, 1/1000, etc.
+	EV                         float64  // The final EV value (at ISO 100) - https://en.wikipedia.org/wiki/Exposure_value
 
 	// This is the only value used downstream; it is used to scale the
 	// pixel values during image fusion.
 	IlluminanceAtMaxExposure   float64  // How many lux generate a channel exposure == 0xFFFF
 }
 
-var(
-	// The sequence of "whole" f-stops from f/1.0 to f/32, as x10 int values
-	apertureX10FStops = []int{10, 14, 20, 28, 40, 56, 80, 110, 160, 220, 320}
-
-	// This sequence isn't quite mathematical
-	shutterSpeeds = []rat64{
-		rat64{1, 4000},
-		rat64{1, 2000},
-		rat64{1, 1000},
-		rat64{1,  500},
-		rat64{1,  250},
-		rat64{1,  125},
-		rat64{1,   60},
-		rat64{1,   30},
-		rat64{1,   15},
-		rat64{1,    8},
-		rat64{1,    4},
-		rat64{1,    2},
-		rat64{1,    1},
-		rat64{2,    1},
-		rat64{4,    1},
-		rat64{8,    1},
-		rat64{16,   1},
-		rat64{32,   1},
-		rat64{64,   1}, // Surely no exposure will be longer than 64 seconds ...
-	}
-	
-	// https://en.wikipedia.org/wiki/Exposure_value#EV_as_a_measure_of_luminance_and_illuminance
-	// Maps the EV to Illuminance, the max incident illumination at the
-	// sensor, measured in Lux (lumens/m^2).
-	illuminanceLookup = map[int]float64 {
-		6:	   160.0,
-		7:     320.0,
-		8:     640.0,
-		9:    1280.0,
-		10:   2560.0,
-		11:   5120.0,
-		12:	 10240.0,
-		13:	 20480.0,
-		14:	 40960.0,
-		15:	 81920.0,
-		16:	163840.0,
-		17:	327680.0,
-		18:	655360.0,
-	}
-)
-
-// An aperture index doesn't have meaning per se, but the distance
-// between two of them does - e.g. differ by 2, then the respective
-// apertures differ by 2 'stops'
-func closestApertureIndex(apertureX10 int) int {
-	ret := 0
-	for i, fstop := range apertureX10FStops {
-		if fstop <= apertureX10 {
-			ret = i
-		}
-	}
-	return ret
-}
-
-func closestShutterSpeedIndex(ssIn rat64) int {
-	ret := 0
-	for i, ss := range shutterSpeeds {
-		if ssIn[0] >= ss[0] && ss[1] >= ssIn[1] {
-			ret = i
-		}
-	}
-	return ret
+// https://en.wikipedia.org/wiki/Exposure_value#EV_as_a_measure_of_luminance_and_illuminance
+// The max incident illumination at the sensor, measured in Lux
+// (lumens/m^2), doubles with each EV; EV 6 is 160 lux.
+func evToIlluminance(ev float64) float64 {
+	return 2.5 * math.Pow(2.0, ev)
 }
 
 func (ev ExposureValue)String() string {
-	s := fmt.Sprintf("f/%.1f", float32(ev.ApertureX10)/10.0)
+	s := fmt.Sprintf("f/%.1f", ev.FNumber)
 	if ev.ShutterSpeed[1] != 1 {
 		s += fmt.Sprintf(", %d/%4d", ev.ShutterSpeed[0], ev.ShutterSpeed[1])
 	} else {
 		s += fmt.Sprintf(", %d", ev.ShutterSpeed[0])
 	}
 	s += fmt.Sprintf(", ISO%d", ev.ISO)
-	return s + fmt.Sprintf(", EV %2d (%6.0f lux)", ev.EV, ev.IlluminanceAtMaxExposure)
+	return s + fmt.Sprintf(", EV %5.2f (%6.0f lux)", ev.EV, ev.IlluminanceAtMaxExposure)
 }
 
 func (ev *ExposureValue)Validate() error {
-	// We know that f/2.8, at 1/4000, is EV=15; figure how we differ from this in stops.
-	apAdj := -1 * (closestApertureIndex(28) - closestApertureIndex(int(ev.ApertureX10)))
-	ssAdj := closestShutterSpeedIndex(rat64{1, 4000}) - closestShutterSpeedIndex(ev.ShutterSpeed)
+	if !(ev.FNumber > 0.0) || math.IsInf(ev.FNumber, 0) || ev.ShutterSpeed[0] <= 0 || ev.ShutterSpeed[1] <= 0 || ev.ISO <= 0 {
+		return fmt.Errorf("(%s) has missing exposure info", ev)
+	}
 
+	// EV = log2(N^2/t), for ISO 100.
 	// Adjust for ISO; the higher the ISO, the less physical light
 	// needed to fully expose.
-	isoAdj := 0
-	switch ev.ISO {
-	case   100: // do nothing
-	case   200: isoAdj = -1
-	case   400: isoAdj = -2
-	case   800: isoAdj = -3
-	case  1600: isoAdj = -4
-	case  3200: isoAdj = -5
-	case  6400: isoAdj = -6
-	case 12800: isoAdj = -7
-	default: return fmt.Errorf("(%s) had unhandled ISO", ev)
-	}
+	evAt100 := math.Log2(ev.FNumber * ev.FNumber / ev.ShutterSpeed.Float64())
+	isoAdj  := -1.0 * math.Log2(float64(ev.ISO) / 100.0)
 
-	ev.EV = 15 + apAdj + ssAdj + isoAdj
+	ev.EV = evAt100 + isoAdj
 
 	if ev.EV < 6 || ev.EV > 18 {
-		return fmt.Errorf("Exposure info looks suspicous, EV=%d: %v\nspAdj=%d, ssAdj=%d, isoAdj=%d\n",
-			ev.EV, ev, apAdj, ssAdj, isoAdj)
+		return fmt.Errorf("Exposure info looks suspicous, EV=%.2f: %v\nevAt100=%.2f, isoAdj=%.2f\n",
+			ev.EV, ev, evAt100, isoAdj)
 	}
 
-	ev.IlluminanceAtMaxExposure = illuminanceLookup[ev.EV]
+	ev.IlluminanceAtMaxExposure = evToIlluminance(ev.EV)
 
 	return nil
 }
@@ -0,0 +1,70 @@
+package eclipse
+
+import(
+	"fmt"
+	"image"
+	"image/color"
+	"log"
+
+	"github.com/abworrall/eclipse-hdr/pkg/ecolor"
+	"github.com/abworrall/eclipse-hdr/pkg/emath"
+	"github.com/abworrall/eclipse-hdr/pkg/mertens"
+)
+
+// ExposureFusion is an alternative to Fuse+Tonemap; it never builds a
+// HDR radiance map. Instead, each aligned layer is developed into an
+// ordinary LDR image (as if it were a single photo), and the best
+// exposed parts of each are blended directly into the final image.
+// The results look more natural, but don't show as much of the
+// corona's dynamic range.
+func (fi *FusedImage)ExposureFusion(filename string) error {
+	log.Printf("Exposure fusion (mertens) of %d layers over %s\n", len(fi.Layers), fi.InputArea)
+
+	imgs := []image.Image{}
+	for i := range fi.Layers {
+		imgs = append(imgs, fi.DevelopLayer(i))
+		if fi.Config.Verbosity > 0 {
+			WritePNG(imgs[i], fmt.Sprintf("mertens-layer-%02d.png", i))
+		}
+	}
+
+	op := mertens.NewDefaultMertens(imgs)
+	op.ContrastWeight    = fi.Config.MertensContrastWeight
+	op.SaturationWeight  = fi.Config.MertensSaturationWeight
+	op.ExposednessWeight = fi.Config.MertensExposednessWeight
+
+	return WritePNG(op.Perform(), filename)
+}
+
+// DevelopLayer renders the input area of a single layer as an sRGB
+// image, using the same developer as Fuse, but clipping and gamma
+// compressing it like a camera's JPEG would.
+func (fi *FusedImage)DevelopLayer(i int) image.Image {
+	l      := fi.Layers[i]
+	bounds := fi.InputArea
+	out    := image.NewRGBA64(image.Rectangle{Max:image.Point{bounds.Dx(), bounds.Dy()}})
+
+	developer := fi.Config.GetDeveloper()
+	toU16     := func(v float64) uint16 {
+		if v < 0.0 { v = 0.0 }
+		if v > 1.0 { v = 1.0 }
+		return uint16(emath.GammaExpand_F64(v) * float64(0xFFFF) + 0.5)
+	}
+
+	for x:=0; x<bounds.Dx(); x++ {
+		for y:=0; y<bounds.Dy(); y++ {
+			p := Pixel{OutputPos: image.Point{x, y}, LayerNumber: i}
+			p.Fused = ecolor.NewCameraNativeWithResponse(l.Image.At(x + bounds.Min.X, y + bounds.Min.Y), l.ExposureValue.IlluminanceAtMaxExposure, fi.Config.ResponseCurve)
+			developer(fi.Config, &p)
+
+			out.SetRGBA64(x, y, color.RGBA64{
+				R: toU16(p.DevelopedRGB.R),
+				G: toU16(p.DevelopedRGB.G),
+				B: toU16(p.DevelopedRGB.B),
+				A: 0xFFFF,
+			})
+		}
+	}
+
+	return out
+}
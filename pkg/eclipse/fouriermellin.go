@@ -0,0 +1,42 @@
+package eclipse
+
+import(
+	"log"
+
+	"github.com/abworrall/eclipse-hdr/pkg/emath"
+)
+
+// AlignLayerFourierMellin first finds the rotation and scale between
+// the layers (using Fourier-Mellin registration, which ignores any
+// translation), and then finetunes the translation using phase
+// correlation.
+func AlignLayerFourierMellin(cfg Config, l1, l2 *Layer, baseXform AlignmentTransform) (AlignmentTransform, error) {
+	evMax, lo, hi := commonLuminanceRange(cfg, l1, l2)
+	g1 := phaseCorrGrid(cfg, l1.Image, l1.ExposureValue, evMax, lo, hi)
+
+	// We only want the streamers, so remove everything that is the same
+	// all the way round the moon (baseXform has centred l2's moon on
+	// l1's moon).
+	cent := l1.LunarLimb.Center().Sub(cfg.InputArea.Min)
+	cx, cy := float64(cent.X), float64(cent.Y)
+	g1.SubtractRadialProfile(cx, cy)
+
+	// As with the translation, a second pass mops up the residual
+	xform := baseXform
+	for pass:=1; pass<=2; pass++ {
+		g2 := phaseCorrGrid(cfg, xform.XFormImage(l2.LoadedImage), l2.ExposureValue, evMax, lo, hi)
+		g2.SubtractRadialProfile(cx, cy)
+		rotDeg, scale, peak := emath.LogPolarCorrelate(g1, g2)
+
+		if peak < 0.1 {
+			log.Printf("Align fouriermellin: pass%d: no clear correlation peak (%.3f), skipping rotation/scale\n", pass, peak)
+			break
+		}
+
+		xform.RotateByDeg += rotDeg
+		xform.ScaleBy = xform.Scale() * scale
+		log.Printf("Align fouriermellin: pass%d: rotate by %.3fdeg, scale by %.4f (peak %.3f)\n", pass, rotDeg, scale, peak)
+	}
+
+	return AlignLayerPhaseCorrelation(cfg, l1, l2, xform)
+}
@@ -5,10 +5,12 @@ import(
 	"image/color"
 	"fmt"
 	"log"
-	"os"
+	"math"
+	"path/filepath"
+	"runtime"
 	"sort"
+	"sync"
 
-	"github.com/mdouchement/hdr/codec/rgbe"
 	"github.com/mdouchement/hdr/hdrcolor"
 
 	"github.com/abworrall/eclipse-hdr/pkg/ecolor"
@@ -19,23 +21,35 @@ import(
 type FusedImage struct {
 	Config
 	Layers   []Layer // Ordered, ascending EV (descending "number of photons needed to fully expose")
-	Pixels   []Pixel
+
+	// The fused image, as flat planes over the OutputArea, a row at a time
+	R, G, B     []float32 // The developed (white balanced, color-corrected) HDR color
+	LayerNumber []uint8   // Which layer the fuser used; or how many layers it used
+	NumClipped  []uint8   // How many layers were clipped
+	NumGhosted  []uint8   // How many layers were rejected as ghosts
+
+	Reference int    // Index into Layers of the layer that the others are aligned to
+
+	Calibration CalibrationFrames // Darks, biases and flats, applied to the Layers at the start of Align
 }
 
 var DebugPixels = []image.Point{} // Things in here get dumped in detail
 
+const fuseTileSize = 256 // Fuse hands out the output area to the workers in squares this big
+
 // Implement image.Image
 func (fi FusedImage)ColorModel() color.Model       { return hdrcolor.RGBModel }
 func (fi FusedImage)Bounds() image.Rectangle       { return fi.OutputArea }
 func (fi FusedImage)At(x, y int) color.Color       { return fi.HDRAt(x,y) }
 
 // Implement hdr.Image
-func (fi FusedImage)HDRAt(x, y int) hdrcolor.Color { return fi.Pix(x,y).DevelopedRGB }
+func (fi FusedImage)HDRAt(x, y int) hdrcolor.Color { return fi.rgbAt(fi.index(x, y)) }
 func (fi FusedImage)Size() int                     { return fi.Bounds().Dx() * fi.Bounds().Dy() }
 
 // Pixel access
-func (fi *FusedImage)Pix(x, y int) Pixel           { return fi.Pixels[x * fi.OutputArea.Dy() + y ] }
-func (fi *FusedImage)PixRW(x, y int) *Pixel        { return &(fi.Pixels[x * fi.OutputArea.Dy() + y ]) }
+func (fi *FusedImage)index(x, y int) int           { return y * fi.OutputArea.Dx() + x }
+func (fi *FusedImage)rgbAt(i int) hdrcolor.RGB     { return hdrcolor.RGB{float64(fi.R[i]), float64(fi.G[i]), float64(fi.B[i])} }
+func (fi *FusedImage)setRGB(i int, c hdrcolor.RGB) { fi.R[i], fi.G[i], fi.B[i] = float32(c.R), float32(c.G), float32(c.B) }
 
 func NewFusedImage() FusedImage {
 	return FusedImage{
@@ -59,23 +73,51 @@ func (fi *FusedImage)AddLayer(l Layer) {
 
 // Align does all the work to figure out how to align the various
 // layers, and generates the final transformed image for each layer.
-func (fi *FusedImage)Align() {
+func (fi *FusedImage)Align() error {
 	if len(fi.Layers) == 0 {
-		return
+		return nil
+	}
+
+	if err := fi.Config.Validate(); err != nil {
+		return err
+	}
+
+	// Calibrate first, now the config (incl. ClipFraction) is final
+	if err := fi.ApplyCalibrationFrames(); err != nil {
+		return fmt.Errorf("calibration frames: %v", err)
 	}
 
 	log.Printf("Aligning image layers")
 
 	if fi.Config.DoEclipseAlignment {
-		for i:=0; i<len(fi.Layers); i++ {
-			fi.Layers[i].LunarLimb = FindLunarLimb(fi.Config, fi.Layers[i].LoadedImage)
+		if err := fi.FindLunarLimbs(); err != nil {
+			return err
+		}
+		if err := fi.PickReferenceLayer(); err != nil {
+			return err
 		}
 		fi.InputArea  = fi.CalculateInputArea()
 		fi.Config.InputArea = fi.InputArea // aligner needs this
 
-		// Figure out the transforms to map points from the base/first image to the other images
-		for i:=1; i<len(fi.Layers); i++ {
-			AlignLayer(fi.Config, &fi.Layers[0], &fi.Layers[i])
+		ref := &fi.Layers[fi.Reference]
+		var cache *AlignmentCache
+		if fi.Config.DoAlignmentCache {
+			cache = LoadAlignmentCache(filepath.Dir(ref.LoadFilename))
+		}
+
+		// Figure out the transforms to map points from the reference image to the other images
+		for i:=0; i<len(fi.Layers); i++ {
+			if i != fi.Reference {
+				if err := AlignLayer(fi.Config, ref, &fi.Layers[i], cache); err != nil {
+					return err
+				}
+			}
+		}
+
+		if cache != nil {
+			if err := cache.Save(); err != nil {
+				log.Printf("%v\n", err)
+			}
 		}
 
 		if fi.Config.DoFineTunedAlignment {
@@ -90,83 +132,259 @@ func (fi *FusedImage)Align() {
 	fi.OutputArea = image.Rectangle{ Max:image.Point{fi.InputArea.Dx(), fi.InputArea.Dy()} } 
 	fi.Config.OutputArea = fi.OutputArea // Copy it into the config, so PixelFuncs can see it, sigh
 
+	// Now everything is aligned, merge any bursts of photos taken with the same exposure
+	fi.StackLayers()
+
 	log.Printf("Layers loaded and aligned: %s", fi)
+	return nil
 }
 
 // Fuse looks at the various layers for each pixel, and figures out a
 // final merged value for that pixel. There are a few algorithms to
 // pick from. Then it normalizes the brightness, so each pixel has the
 // same EV. Finally it does color development, white balance etc.
+//
+// The work is split into tiles, over a pool of goroutines. Only the
+// results are kept (in the R,G,B etc. planes); the full details of
+// each Pixel are thrown away, except for the DebugPixels.
 func (fi *FusedImage)Fuse() {
 	log.Printf("Fusing image layers over %s", fi.OutputArea)
-	fi.Pixels = make([]Pixel, fi.OutputArea.Dx() * fi.OutputArea.Dy())
-	
+	n := fi.OutputArea.Dx() * fi.OutputArea.Dy()
+	fi.R, fi.G, fi.B = make([]float32, n), make([]float32, n), make([]float32, n)
+	fi.LayerNumber = make([]uint8, n)
+	fi.NumClipped  = make([]uint8, n)
+	fi.NumGhosted  = make([]uint8, n)
+
+	// The fused pixels each have their own IllumAtMax, so until we know
+	// the biggest one, store them as absolute values (scaled up by it).
+	tiles := fi.forEachPixel(func(t *fuseTile, p *Pixel) {
+		fi.fusePixel(p)
+
+		i := fi.index(p.OutputPos.X, p.OutputPos.Y)
+		fi.R[i] = float32(p.Fused.RGB.R * p.Fused.IllumAtMax)
+		fi.G[i] = float32(p.Fused.RGB.G * p.Fused.IllumAtMax)
+		fi.B[i] = float32(p.Fused.RGB.B * p.Fused.IllumAtMax)
+		fi.LayerNumber[i] = uint8(p.LayerNumber)
+		fi.NumGhosted[i]  = uint8(p.NumGhosted())
+		for _, clipped := range p.Clipped {
+			if clipped { fi.NumClipped[i]++ }
+		}
+
+		if p.Fused.IllumAtMax > t.IllumAtMax {
+			t.IllumAtMax = p.Fused.IllumAtMax
+		}
+		if p.AllClipped() {
+			t.NumAllClipped++
+		}
+		if p.NumGhosted() > 0 {
+			t.NumGhosted++
+		}
+	})
+
 	globalIllumAtMax := 0.0
-	for x:=0; x<fi.OutputArea.Dx(); x++ {
-		for y:=0; y<fi.OutputArea.Dy(); y++ {
+	nAllClipped, nGhosted := 0, 0
+	for _, t := range tiles {
+		globalIllumAtMax = math.Max(globalIllumAtMax, t.IllumAtMax)
+		nAllClipped += t.NumAllClipped
+		nGhosted    += t.NumGhosted
+	}
 
-			p := fi.PixRW(x, y) // Get a pointer to the Pixel, so we can mutate it
+	developer := fi.Config.GetDeveloper()
+	fi.forEachPixel(func(t *fuseTile, p *Pixel) {
+		i := fi.index(p.OutputPos.X, p.OutputPos.Y)
 
-			p.OutputPos = image.Point{x, y}
-			p.RawInputs = make([]color.Color, len(fi.Layers))
-			p.In = make([]ecolor.CameraNative, len(fi.Layers))
+		// Adjust all the pixels to the same max illuminance.
+		p.Fused = ecolor.CameraNative{IllumAtMax: globalIllumAtMax}
+		p.Fused.RGB = hdrcolor.RGB{
+			R: float64(fi.R[i]) / globalIllumAtMax,
+			G: float64(fi.G[i]) / globalIllumAtMax,
+			B: float64(fi.B[i]) / globalIllumAtMax,
+		}
+		p.LayerNumber = int(fi.LayerNumber[i])
 
-			// Gather the inputs from all the layers
-			for i:=0; i<len(fi.Layers); i++ {
-				p.RawInputs[i] = fi.Layers[i].Image.At(x + fi.InputArea.Min.X, y + fi.InputArea.Min.Y)
-				p.In[i] = ecolor.NewCameraNative(p.RawInputs[i], fi.Layers[i].ExposureValue.IlluminanceAtMaxExposure)
-			}
+		developer(fi.Config, p)                      // "Develop" the pixel (white balance etc.)
+		fi.setRGB(i, p.DevelopedRGB)
+	})
 
-			// Now run the fuser
-			fuser := fi.Config.GetFuser()
-			fuser(fi.Config, p)
+	if nAllClipped > 0 {
+		log.Printf("%d pixels were clipped in every layer\n", nAllClipped)
+	}
+	if nGhosted > 0 {
+		log.Printf("%d pixels had ghosts rejected\n", nGhosted)
+	}
 
-			if p.Fused.IllumAtMax > globalIllumAtMax {
-				globalIllumAtMax = p.Fused.IllumAtMax
-			}
+	// Do the DebugPixels again, the slow way, so we can see all the details
+	for _, pt := range DebugPixels {
+		p := fi.newPixel()
+		p.OutputPos = pt
+		fi.fusePixel(&p)
+		p.Fused.AdjustIllumAtMax(globalIllumAtMax)
+		developer(fi.Config, &p)
+		log.Printf("%s", p)
+	}
+}
+
+// A fuseTile is a rectangle of the output area, for a single worker to
+// process; along with some stats about the pixels in it.
+type fuseTile struct {
+	Bounds        image.Rectangle // In output coords
+
+	IllumAtMax    float64 // The biggest IllumAtMax of any fused pixel
+	NumAllClipped int     // How many pixels were clipped in every layer
+	NumGhosted    int     // How many pixels had a ghost rejected
+}
+
+// newPixel returns a Pixel with space for all the layers.
+func (fi *FusedImage)newPixel() Pixel {
+	return Pixel{
+		RawInputs: make([]color.Color, len(fi.Layers)),
+		In:        make([]ecolor.CameraNative, len(fi.Layers)),
+		Clipped:   make([]bool, len(fi.Layers)),
+	}
+}
+
+// fusePixel gathers the inputs from all the layers at p.OutputPos, and
+// runs the fuser over them.
+func (fi *FusedImage)fusePixel(p *Pixel) {
+	x, y := p.OutputPos.X, p.OutputPos.Y
+	for i:=0; i<len(fi.Layers); i++ {
+		p.RawInputs[i] = fi.Layers[i].Image.At(x + fi.InputArea.Min.X, y + fi.InputArea.Min.Y)
+		p.In[i] = ecolor.NewCameraNativeWithResponse(p.RawInputs[i], fi.Layers[i].ExposureValue.IlluminanceAtMaxExposure, fi.Config.ResponseCurve)
+		p.Clipped[i] = fi.Layers[i].IsClipped(fi.Config, p.RawInputs[i])
+	}
+	if fi.Config.GhostThreshold > 0.0 {
+		RejectGhosts(fi.Config, p)
+	}
+
+	p.Fused = ecolor.CameraNative{}
+	p.LayerNumber = 0
+	fuser := fi.Config.GetFuser()
+	fuser(fi.Config, p)
+}
+
+// forEachPixel cuts the output area up into tiles, and runs `f` over
+// every pixel in them, using a pool of goroutines. Each goroutine
+// reuses the same Pixel (with p.OutputPos set to where it is), so we
+// don't allocate anything per pixel. It returns the tiles, so the
+// caller can collect up any stats that `f` left in them.
+func (fi *FusedImage)forEachPixel(f func(t *fuseTile, p *Pixel)) []fuseTile {
+	area  := image.Rectangle{Max:image.Point{fi.OutputArea.Dx(), fi.OutputArea.Dy()}}
+	tiles := []fuseTile{}
+	for y:=0; y<area.Max.Y; y+=fuseTileSize {
+		for x:=0; x<area.Max.X; x+=fuseTileSize {
+			tiles = append(tiles, fuseTile{Bounds: image.Rect(x, y, x+fuseTileSize, y+fuseTileSize).Intersect(area)})
 		}
 	}
 
+	jobsChan := make(chan int, len(tiles))
+	for i := range tiles {
+		jobsChan<- i
+	}
+	close(jobsChan)
+
+	var wg sync.WaitGroup
+	for w:=0; w<runtime.NumCPU(); w++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			p := fi.newPixel()
+			for i := range jobsChan {
+				t := &tiles[i]
+				for y:=t.Bounds.Min.Y; y<t.Bounds.Max.Y; y++ {
+					for x:=t.Bounds.Min.X; x<t.Bounds.Max.X; x++ {
+						p.OutputPos = image.Point{x, y}
+						f(t, &p)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	return tiles
+}
+
+// ClippingMask shows where the fusers had to skip clipped samples.
+// Pixels get brighter the more layers were clipped there; pixels that
+// were clipped in every layer (so the fused value is clipped too) are
+// red.
+func (fi *FusedImage)ClippingMask() image.Image {
+	return fi.layerMask(fi.NumClipped)
+}
+
+// layerMask draws a pixel brighter the more layers are counted there,
+// and red if they all are.
+func (fi *FusedImage)layerMask(counts []uint8) image.Image {
+	out := image.NewRGBA64(image.Rectangle{Max:image.Point{fi.OutputArea.Dx(), fi.OutputArea.Dy()}})
+
 	for x:=0; x<fi.OutputArea.Dx(); x++ {
 		for y:=0; y<fi.OutputArea.Dy(); y++ {
-			p := fi.PixRW(x, y)
-
-			p.Fused.AdjustIllumAtMax(globalIllumAtMax) 	 // Adjust all the pixels to the same max illuminance.
-			developer := fi.Config.GetDeveloper()
-			developer(fi.Config, p)                      // "Develop" the pixel (white balance etc.)
+			n := int(counts[fi.index(x, y)])
+			if n > 0 && n == len(fi.Layers) {
+				out.SetRGBA64(x, y, color.RGBA64{0xFFFF, 0, 0, 0xFFFF})
+				continue
+			}
+			v := uint16(n * 0xC000 / len(fi.Layers))
+			out.SetRGBA64(x, y, color.RGBA64{v, v, v, 0xFFFF})
 		}
 	}
 
-	for _, pt := range DebugPixels {
-		log.Printf("%s", fi.Pix(pt.X, pt.Y))
+	return out
+}
+
+func (fi *FusedImage)WriteClippingMask(filename string) error {
+	if err := WritePNG(fi.ClippingMask(), filename); err != nil {
+		log.Printf("FusedImage.WriteClippingMask: %v\n", err)
+		return err
 	}
+	return nil
 }
 
 // WriteToHDR outputs a HDR image. You can load this into photoshop or other HDR tools.
 func (fi *FusedImage)WriteToHDR(filename string) error {
-	if writer, err := os.Create(filename); err != nil {
-		return fmt.Errorf("FusedImage.WriteToHDR, open+w '%s': %v", filename, err)
-	} else {
-		defer writer.Close()
-		err := rgbe.Encode(writer, fi)
-		if err != nil {
-			log.Printf("FusedImage.WriteToHDR, encoding RGBE file: %v\n", err)
-		}
+	if err := WriteHDR(fi, filename, fi.HDRComments()...); err != nil {
+		log.Printf("FusedImage.WriteToHDR: %v\n", err)
 		return err
 	}
+	return nil
+}
+
+// HDRComments returns things about the image worth recording in the
+// header of the HDR files.
+func (fi *FusedImage)HDRComments() []string {
+	comments := []string{"Created by eclipse-hdr"}
+	if fi.Config.OrientNorth != "" {
+		comments = append(comments, fmt.Sprintf("OutputRotationDeg=%.3f (clockwise, to put %s north up)",
+			fi.Config.OutputRotationDeg, fi.Config.OrientNorth))
+	}
+	return comments
+}
+
+// LunarLimbInOutputArea returns the center and radius of the lunar
+// limb in the reference layer, in output coords. If we never looked for
+// the lunar limb, it assumes the output is centered on the moon.
+func (fi *FusedImage)LunarLimbInOutputArea() (image.Point, float64) {
+	if len(fi.Layers) == 0 || fi.RefLayer().LunarLimb.Radius() == 0 {
+		radius := float64(fi.OutputArea.Dx()) / (2.0 * fi.Config.OutputWidthInSolarDiameters)
+		return RectCenter(fi.OutputArea), radius
+	}
+
+	center := fi.RefLayer().LunarLimb.Center().Sub(fi.InputArea.Min)
+	return center, fi.RefLayer().LunarLimb.PreciseRadius()
 }
 
 func (fi *FusedImage)CalculateInputArea() image.Rectangle {
 	// Figure out which area of the input we're going to process, in both input coords and output coords
-	center    := fi.Layers[0].LunarLimb.Center()
-	radiusPix := fi.Layers[0].LunarLimb.Radius() + 3
+	center    := fi.RefLayer().LunarLimb.Center()
+	radiusPix := int(math.Ceil(fi.RefLayer().LunarLimb.PreciseRadius())) + 3
 	width     := int( float64(radiusPix) * fi.Config.OutputWidthInSolarDiameters)
 	bounds    := image.Rectangle{
 		Min: image.Point{center.X - width, center.Y - width},
 		Max: image.Point{center.X + width, center.Y + width},
 	}
 
-	// if !bounds.In(fi.Layers[0].LoadedImage.Bounds()) {}
+	// if !bounds.In(fi.RefLayer().LoadedImage.Bounds()) {}
 
 	return bounds
 }
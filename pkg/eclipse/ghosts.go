@@ -0,0 +1,81 @@
+package eclipse
+
+import(
+	"image"
+	"log"
+	"math"
+	"sort"
+)
+
+const ghostNoiseFloor = 0.02 // Samples dimmer than this (in [0,1]) are mostly noise, so don't get a vote
+
+// RejectGhosts looks for layers that disagree with the others at this
+// pixel; e.g. a plane or a cloud that was only there for one of the
+// exposures, or the lunar limb moving between the first and last
+// frame. Every layer is normalized to the same EV, and the median is
+// taken as the reference (so that a single ghost can't drag it off);
+// any layer more than GhostThreshold (as a fraction) away from it is
+// marked as a ghost, and the fusers skip it, just like a clipped
+// sample.
+//
+// Only layers that are well exposed (not clipped, and above the noise
+// floor) get a vote, and there need to be at least three votes, or we
+// can't tell which one is wrong.
+func RejectGhosts(cfg Config, p *Pixel) {
+	if len(p.Ghosted) != len(p.In) {
+		p.Ghosted = make([]bool, len(p.In))
+	}
+	for i := range p.Ghosted {
+		p.Ghosted[i] = false
+	}
+
+	maxIllum := 0.0
+	for i:=0; i<len(p.In); i++ {
+		if p.In[i].IllumAtMax > maxIllum { maxIllum = p.In[i].IllumAtMax }
+	}
+
+	votes := []float64{}
+	for i:=0; i<len(p.In); i++ {
+		_, Y, _, _ := p.In[i].HDRXYZA()
+		if (i >= len(p.Clipped) || !p.Clipped[i]) && Y > ghostNoiseFloor {
+			votes = append(votes, Y * p.In[i].IllumAtMax / maxIllum)
+		}
+	}
+	if len(votes) < 3 {
+		return
+	}
+
+	sort.Float64s(votes)
+	ref := votes[len(votes)/2]
+	if len(votes) % 2 == 0 {
+		ref = (ref + votes[len(votes)/2 - 1]) / 2.0
+	}
+
+	for i:=0; i<len(p.In); i++ {
+		if i < len(p.Clipped) && p.Clipped[i] {
+			continue
+		}
+
+		// Compare in the layer's own units, so the noise floor means the
+		// same thing for every layer.
+		_, Y, _, _ := p.In[i].HDRXYZA()
+		expected := ref * maxIllum / p.In[i].IllumAtMax
+		if math.Abs(Y - expected) / math.Max(expected, ghostNoiseFloor) > cfg.GhostThreshold {
+			p.Ghosted[i] = true
+		}
+	}
+}
+
+// GhostMask shows where RejectGhosts threw out samples; pixels get
+// brighter the more layers were rejected there.
+func (fi *FusedImage)GhostMask() image.Image {
+	return fi.layerMask(fi.NumGhosted)
+}
+
+func (fi *FusedImage)WriteGhostMask(filename string) error {
+	if err := WritePNG(fi.GhostMask(), filename); err != nil {
+		log.Printf("FusedImage.WriteGhostMask: %v\n", err)
+		return err
+	}
+	return nil
+}
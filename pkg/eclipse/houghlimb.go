@@ -0,0 +1,215 @@
+package eclipse
+
+import(
+	"fmt"
+	"image"
+	"log"
+	"math"
+
+	"github.com/abworrall/eclipse-hdr/pkg/emath"
+)
+
+const(
+	lunarAngularRadiusDeg = 0.2625 // Roughly; it varies by a few % over the lunar orbit
+
+	houghRadiusTolerance = 0.08  // Search radii this far either side of the expected radius
+	houghGridRadius      = 100.0 // Downsample until the moon is about this many pixels across ...
+	houghEdgeThresh      = 0.25  // ... and count anything with a log luminance gradient above this as an edge
+	houghMinArc          = 0.15  // The fraction of the circumference that needs to be seen
+)
+
+// A houghEdge is an edge pixel in the downsampled grid, with the
+// direction the luminance increases in.
+type houghEdge struct {
+	X, Y   float64
+	Ux, Uy float64
+}
+
+// FindLunarLimbHough looks for the moon as a dark disk of roughly the
+// expected radius, using a circular Hough transform. Unlike the
+// floodfill, it doesn't need the limb to be surrounded by corona, so
+// it copes with diamond ring, Baily's beads and partial phase frames.
+//
+// Each edge pixel votes for the points `r` pixels away from it, in the
+// direction it gets darker; edges on the bright side of something
+// (like the sun's own limb, in a partial phase) vote outwards, and
+// don't pile up anywhere.
+func FindLunarLimbHough(cfg Config, img image.Image, expectedRadius float64) (LunarLimb, error) {
+	ll := LunarLimb{}
+	if expectedRadius <= 0.0 {
+		return ll, fmt.Errorf("hough: no expected lunar radius")
+	}
+
+	f := int(math.Max(1.0, math.Floor(expectedRadius / houghGridRadius)))
+	g := houghLogGrid(img, f)
+	edges := houghEdges(&g)
+
+	rMin := int(math.Floor(expectedRadius * (1.0 - houghRadiusTolerance) / float64(f)))
+	rMax := int(math.Ceil(expectedRadius * (1.0 + houghRadiusTolerance) / float64(f)))
+
+	// Vote for centers
+	acc := emath.NewFloatGrid(g.Dx(), g.Dy())
+	for _, e := range edges {
+		for r:=rMin; r<=rMax; r++ {
+			x := int(math.Round(e.X - float64(r)*e.Ux))
+			y := int(math.Round(e.Y - float64(r)*e.Uy))
+			if x >= 0 && y >= 0 && x < acc.Dx() && y < acc.Dy() {
+				acc.Set(x, y, acc.Get(x, y) + 1.0)
+			}
+		}
+	}
+
+	// The votes smear out over a pixel or so; find the 3x3 block with the most
+	bestX, bestY, bestVotes := 0, 0, 0.0
+	for x:=1; x<acc.Dx()-1; x++ {
+		for y:=1; y<acc.Dy()-1; y++ {
+			votes := 0.0
+			for i:=-1; i<=1; i++ {
+				for j:=-1; j<=1; j++ {
+					votes += acc.Get(x+i, y+j)
+				}
+			}
+			if votes > bestVotes {
+				bestX, bestY, bestVotes = x, y, votes
+			}
+		}
+	}
+	if bestVotes == 0.0 {
+		return ll, fmt.Errorf("hough: no edges found")
+	}
+
+	// Take the centroid of the votes around the peak, for a sub-pixel center
+	cx, cy, n := 0.0, 0.0, 0.0
+	for i:=-1; i<=1; i++ {
+		for j:=-1; j<=1; j++ {
+			v := acc.Get(bestX+i, bestY+j)
+			cx += v * float64(bestX+i)
+			cy += v * float64(bestY+j)
+			n  += v
+		}
+	}
+	cx, cy = cx/n, cy/n
+
+	// Now find the radius; histogram the distances of the edges that
+	// face the center.
+	hist := make([]int, rMax-rMin+1)
+	for _, e := range houghEdgesFacing(edges, cx, cy) {
+		if i := int(math.Round(math.Hypot(e.X-cx, e.Y-cy))) - rMin; i >= 0 && i < len(hist) {
+			hist[i]++
+		}
+	}
+	bestR, support := 0, 0
+	for i, count := range hist {
+		if count > support {
+			bestR, support = i+rMin, count
+		}
+	}
+	if float64(support) < houghMinArc * 2.0 * math.Pi * float64(bestR) {
+		return ll, fmt.Errorf("hough: best circle (r=%d) only has %d edge pixels, out of %d", bestR*f, support, len(edges))
+	}
+
+	// The accumulator peak can be a pixel or two out, especially if we
+	// only see a short arc; a least squares fit to the supporting edges
+	// does better.
+	fr := float64(bestR)
+	for i:=0; i<3; i++ {
+		support := []limbEdge{}
+		for _, e := range houghEdgesFacing(edges, cx, cy) {
+			if math.Abs(math.Hypot(e.X-cx, e.Y-cy) - fr) < 1.5 {
+				support = append(support, limbEdge{e.X, e.Y})
+			}
+		}
+		if len(support) < 10 {
+			break
+		}
+		if x, y, r, err := leastSquaresCircle(support); err == nil && math.Abs(r-fr) < 2.0 {
+			cx, cy, fr = x, y, r
+		}
+	}
+
+	// Back into image coords
+	bounds := img.Bounds()
+	x, y, r := (cx+0.5)*float64(f) - 0.5 + float64(bounds.Min.X), (cy+0.5)*float64(f) - 0.5 + float64(bounds.Min.Y), fr*float64(f)
+
+	ll.LuminalCenter = image.Point{int(math.Round(x)), int(math.Round(y))}
+	ll.Bounds = image.Rect(int(x-r), int(y-r), int(x+r), int(y+r))
+	for i:=-5; i<5; i++ {
+		ll.Brightness += ColToGrayU16(img.At(ll.LuminalCenter.X+i, ll.LuminalCenter.Y))
+	}
+	ll.Brightness /= 10
+
+	dci.StartNewFrame(bounds, ll.LuminalCenter)
+	log.Printf("Hough found a lunar limb at (%.1f,%.1f) r=%.1f (%d edge pixels)\n", x, y, r, support)
+
+	// The Hough answer is only good to a pixel or so at full res, so
+	// try a proper circle fit around it. The rays stop short of where
+	// they might hit the sun's limb; but if the fit still disagrees too
+	// much, stick with Hough.
+	thresh := uint16(0x1000)
+	if ll.Brightness < 0x0015 {
+		thresh = uint16(0x0040)
+	}
+	tol := 2.0 * float64(f)
+	if err := ll.fitCircle(img, thresh, r + 2.0*tol); err != nil || math.Abs(ll.FitRadius-r) > tol || math.Hypot(ll.FitCenterX-x, ll.FitCenterY-y) > tol {
+		ll.FitCenterX, ll.FitCenterY, ll.FitRadius = x, y, r
+		ll.FitResidual = float64(f)
+		ll.FitInliers, ll.FitEdgePoints = support, len(edges)
+	}
+
+	dci.PlotCircle(ll.FitCenterX, ll.FitCenterY, ll.FitRadius)
+	if cfg.Verbosity > 0 {
+		dci.Flush()
+	}
+
+	return ll, nil
+}
+
+// houghLogGrid downsamples the image by a factor of f, into the log
+// of the (gray) luminance. Anything dimmer than the noise floor is
+// clamped, so noise inside the limb doesn't look like edges.
+func houghLogGrid(img image.Image, f int) emath.FloatGrid {
+	bounds := img.Bounds()
+	g := emath.NewFloatGrid(bounds.Dx()/f, bounds.Dy()/f)
+	for x:=0; x<g.Dx(); x++ {
+		for y:=0; y<g.Dy(); y++ {
+			sum := 0.0
+			for i:=0; i<f; i++ {
+				for j:=0; j<f; j++ {
+					sum += float64(ColToGrayU16(img.At(bounds.Min.X + x*f + i, bounds.Min.Y + y*f + j)))
+				}
+			}
+			g.Set(x, y, math.Log(math.Max(sum / float64(f*f), 0x0040)))
+		}
+	}
+	return g
+}
+
+// houghEdges runs a Sobel filter over the grid, and returns the pixels
+// with a strong enough gradient.
+func houghEdges(g *emath.FloatGrid) []houghEdge {
+	edges := []houghEdge{}
+	for x:=1; x<g.Dx()-1; x++ {
+		for y:=1; y<g.Dy()-1; y++ {
+			gx := (g.Get(x+1, y-1) + 2.0*g.Get(x+1, y) + g.Get(x+1, y+1) -
+				g.Get(x-1, y-1) - 2.0*g.Get(x-1, y) - g.Get(x-1, y+1)) / 8.0
+			gy := (g.Get(x-1, y+1) + 2.0*g.Get(x, y+1) + g.Get(x+1, y+1) -
+				g.Get(x-1, y-1) - 2.0*g.Get(x, y-1) - g.Get(x+1, y-1)) / 8.0
+			if mag := math.Hypot(gx, gy); mag > houghEdgeThresh {
+				edges = append(edges, houghEdge{float64(x), float64(y), gx/mag, gy/mag})
+			}
+		}
+	}
+	return edges
+}
+
+// houghEdgesFacing returns the edges that get brighter going away from
+// the center, i.e. could be part of the limb.
+func houghEdgesFacing(edges []houghEdge, cx, cy float64) []houghEdge {
+	facing := []houghEdge{}
+	for _, e := range edges {
+		if d := math.Hypot(e.X-cx, e.Y-cy); d > 0.0 && ((e.X-cx)*e.Ux + (e.Y-cy)*e.Uy) / d > 0.9 {
+			facing = append(facing, e)
+		}
+	}
+	return facing
+}
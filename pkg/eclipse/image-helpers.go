@@ -3,10 +3,14 @@ package eclipse
 // A few helper routines for golang's image libraries
 
 import(
+	"bytes"
 	"fmt"
 	"image"
 	"image/png"
 	"os"
+
+	"github.com/mdouchement/hdr"
+	"github.com/mdouchement/hdr/codec/rgbe"
 )
 
 func RectCenter(b image.Rectangle) image.Point {
@@ -37,3 +41,32 @@ func WritePNG(img image.Image, filename string) error {
 		return png.Encode(writer, img)
 	}
 }
+
+// WriteHDR writes a Radiance RGBE file. Any comments get added to the
+// header (they should each be a single line).
+func WriteHDR(img hdr.Image, filename string, comments ...string) error {
+	buf := bytes.Buffer{}
+	if err := rgbe.Encode(&buf, img); err != nil {
+		return fmt.Errorf("encoding RGBE file '%s': %v", filename, err)
+	}
+
+	// The header starts with a magic line; slot the comments in after it.
+	b := buf.Bytes()
+	magic := bytes.IndexByte(b, '\n') + 1
+	extra := ""
+	for _, comment := range comments {
+		extra += "# " + comment + "\n"
+	}
+
+	if writer, err := os.Create(filename); err != nil {
+		return fmt.Errorf("open+w '%s': %v", filename, err)
+	} else {
+		defer writer.Close()
+		for _, chunk := range [][]byte{b[:magic], []byte(extra), b[magic:]} {
+			if _, err := writer.Write(chunk); err != nil {
+				return fmt.Errorf("writing RGBE file '%s': %v", filename, err)
+			}
+		}
+		return nil
+	}
+}
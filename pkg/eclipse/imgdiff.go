@@ -10,61 +10,66 @@ import(
 )
 
 // ImgDiff compares two images, and returns an error metric; the less
-// similar, the higher the value. It figures out the difference in XYZ
-// luminance for each pixel (after normalizing for EV differences),
-// and returns the average per-lotsof-pixels difference across the set
-// of compared pixels.
+// similar, the higher the value. It figures out the XYZ luminance for
+// each pixel (after normalizing for EV differences), and then scores
+// them using the AlignmentMetric picked in the config (by default,
+// the average per-lotsof-pixels difference across the set of compared
+// pixels).
 //
 // If the pixel in either image is too dim or too bright on any channel, it is
 // ignored, so we only really compare the subset of corona pixels that
 // both images have a reasonable exposure for.
-func ImgDiff(cfg Config, l1, l2 *Layer, passName string, xform AlignmentTransform) float64 {
-	totErr   := 0.0
-	nErr     := 0
-	bounds   := cfg.InputArea
+func ImgDiff(cfg Config, l1, l2 *Layer, passName string, xform AlignmentTransform) (float64, error) {
+	metric, err := cfg.GetAlignmentMetric()
+	if err != nil {
+		return 0.0, err
+	}
 
-	tooLow  := uint32(0x0200)
-	tooHigh := uint32(0x8000)
+	bounds   := cfg.InputArea
 
+	g1       := emath.NewFloatGrid(bounds.Dx(), bounds.Dy())
+	g2       := emath.NewFloatGrid(bounds.Dx(), bounds.Dy())
 	diff     := emath.NewFloatGrid(bounds.Dx(), bounds.Dy())
 	l2image  := xform.XFormImage(l2.LoadedImage)
 
-	nPix, nLow, nHigh := 0,0,0
+	// This is the illuminance at max over the two images (that have diff exposures)
+	evMax := l1.ExposureValue
+	if l2.IlluminanceAtMaxExposure > evMax.IlluminanceAtMaxExposure {
+		evMax = l2.ExposureValue
+	}
+
+	nPix, nErr, nLow, nHigh := 0,0,0,0
 
 	for x:= bounds.Min.X; x<bounds.Max.X; x++ {
 		for y:= bounds.Min.Y; y<bounds.Max.Y; y++ {
 			c1 := l1.Image.At(x, y)
 			c2 := l2image.At(x, y)
-			r1, g1, b1,_ := c1.RGBA()
-			r2, g2, b2,_ := c2.RGBA()
+			gx, gy := x-bounds.Min.X, y-bounds.Min.Y
 
 			nPix++
-			if r1 < tooLow || g1 < tooLow || b1 < tooLow || r2 < tooLow || g2 < tooLow || b2 < tooLow {
+			if e1, e2 := exposureOf(c1), exposureOf(c2); e1 == underExposed || e2 == underExposed {
 				nLow++
+				g1.Set(gx, gy, math.NaN())
+				g2.Set(gx, gy, math.NaN())
 				continue
-			} else if r1 > tooHigh || g1 > tooHigh || b1 > tooHigh || r2 > tooHigh || g2 > tooHigh || b2 > tooHigh {
+			} else if e1 == overExposed || e2 == overExposed {
 				nHigh++
+				g1.Set(gx, gy, math.NaN())
+				g2.Set(gx, gy, math.NaN())
 				continue
 			}
 
-			// This is the illuminance at max over the two images (that have diff exposures)
-			evMax := l1.ExposureValue
-			if l2.IlluminanceAtMaxExposure > evMax.IlluminanceAtMaxExposure {
-				evMax = l2.ExposureValue
-			}
 			Y1 := col2Y(cfg, c1, l1.ExposureValue, evMax)
 			Y2 := col2Y(cfg, c2, l2.ExposureValue, evMax)
 
-			pixErr := math.Abs(Y1 - Y2)
-
-			diff.Set(x-bounds.Min.X, y-bounds.Min.Y, pixErr)
-			totErr += pixErr
+			g1.Set(gx, gy, Y1)
+			g2.Set(gx, gy, Y2)
+			diff.Set(gx, gy, math.Abs(Y1 - Y2))
 			nErr++
 		}
 	}
 
-	// Scale to a number that tends to be in the range 10,000 - 100,000
-	errMetric := totErr * 10000000.0 / float64(nErr)
+	errMetric := metric.Score(&g1, &g2)
 
 	if cfg.Verbosity > 0 {
 		title := fmt.Sprintf("%s: %.1f%% comparable; err=% 7.0f; %s",
@@ -72,13 +77,36 @@ func ImgDiff(cfg Config, l1, l2 *Layer, passName string, xform AlignmentTransfor
 		diff.ToImg(title, fmt.Sprintf("diff-%s-%s.png", xform.Name, passName))
 	}
 
-	return errMetric
+	return errMetric, nil
+}
+
+type exposure int
+const(
+	wellExposed exposure = iota
+	underExposed
+	overExposed
+)
+
+// exposureOf decides if a pixel is usable for comparison with other
+// layers; if any channel is too dim (noise) or too bright
+// (approaching saturation, maybe non-linear), it isn't.
+func exposureOf(c color.Color) exposure {
+	tooLow  := uint32(0x0200)
+	tooHigh := uint32(0x8000)
+
+	r, g, b, _ := c.RGBA()
+	if r < tooLow || g < tooLow || b < tooLow {
+		return underExposed
+	} else if r > tooHigh || g > tooHigh || b > tooHigh {
+		return overExposed
+	}
+	return wellExposed
 }
 
 // Does a full DNG development pass on the pixel, to get into XYZ_D50
 // color space; then returns the Y (luminance). Accounts for differing EVs.
 func col2Y(cfg Config, c color.Color, ev, evMax ExposureValue) float64 {
-	cn := ecolor.NewCameraNative(c, ev.IlluminanceAtMaxExposure)
+	cn := ecolor.NewCameraNativeWithResponse(c, ev.IlluminanceAtMaxExposure, cfg.ResponseCurve)
 	cn.AdjustIllumAtMax(evMax.IlluminanceAtMaxExposure)
 	xyz := cn.ToPCS(cfg.CameraToPCS)
 
@@ -3,7 +3,10 @@ package eclipse
 import (
 	"fmt"
 	"image"
+	"image/color"
+	"math"
 	"path/filepath"
+	"time"
 
 	"github.com/abworrall/eclipse-hdr/pkg/emath"
 )
@@ -17,18 +20,50 @@ type Layer struct {
 	ExposureValue                   // The exposure value for the photo
 	CameraWhite        emath.Vec3   // A white/neutral color for the photo, given the color temp / white balance
 	CameraToPCS        emath.Mat3   // Maps camera native color to PCS (CIEXYZ(D50?), incl. white balancing
+	FocalLengthMM      float64      // 0 if not known
+	PixelsPerMM        float64      // Sensor resolution (FocalPlaneXResolution); 0 if not known
+	CameraTime         time.Time    // When the photo was taken, according to the camera clock; zero if not known
+	CameraModel        string       // From EXIF; "" if not known
+	WhiteLevel         emath.Vec3   // The value (in [0,1]) that each channel clips at
 
 	// Data we compute
 	LunarLimb                       // Our guess at where the moon is in the photo
 	AlignmentTransform              // How to map a point from the base image into this image
+	StackedFilenames []string       // If this layer is a stack of several photos with the same exposure, these are they
+	NumRejected        int          // How many samples were rejected when stacking
 
 	// _This_ image is aligned across layers, so a pixel at [x,y] relates to the same bit of sky on every layer
 	image.Image
 }
 
 func (l Layer)String() string {
-	return fmt.Sprintf("%s: %s, xform%s, lunar radius %d, lunar brightness 0x%004x",
+	str := fmt.Sprintf("%s: %s, xform%s, lunar radius %d, lunar brightness 0x%004x",
 		l.Filename(), l.ExposureValue.String(), l.AlignmentTransform, l.LunarLimb.Radius(), l.LunarLimb.Brightness)
+	if len(l.StackedFilenames) > 1 {
+		str += fmt.Sprintf(", stack of %d %v (%d samples rejected)", len(l.StackedFilenames), l.StackedFilenames, l.NumRejected)
+	}
+	return str
+}
+
+// ExpectedLunarRadius returns how many pixels the moon's radius
+// should be, given the focal length; 0 if we don't know enough.
+func (l Layer)ExpectedLunarRadius() float64 {
+	return l.FocalLengthMM * math.Tan(lunarAngularRadiusDeg * math.Pi / 180.0) * l.PixelsPerMM
+}
+
+// IsClipped says whether any channel of the sample (as read from the
+// layer's image) has reached the white level, give or take
+// ClipFraction. The sensor can't tell us how bright a clipped sample
+// really was, and if only some of the channels clip the color is wrong
+// too, so the fusers shouldn't use it.
+func (l Layer)IsClipped(cfg Config, col color.Color) bool {
+	r, g, b, _ := col.RGBA()
+	for i, v := range []uint32{r, g, b} {
+		if float64(v) / float64(0xFFFF) >= l.WhiteLevel[i] * cfg.ClipFraction {
+			return true
+		}
+	}
+	return false
 }
 
 func (l Layer)Filename() string {
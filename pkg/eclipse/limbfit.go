@@ -0,0 +1,163 @@
+package eclipse
+
+import(
+	"fmt"
+	"image"
+	"math"
+	"math/rand"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+const(
+	limbRays           = 720 // How many rays to cast out from the LuminalCenter
+	limbRansacIters    = 500
+	limbRansacInlierPx = 1.5 // How close an edge point needs to be to the circle
+)
+
+// A limbEdge is a sub-pixel point on the edge of the lunar limb.
+type limbEdge struct {
+	X, Y float64
+}
+
+// fitCircle refines the (bounding box) estimate of the limb. It casts
+// rays out from the LuminalCenter, finds where each one first crosses
+// the brightness threshold, and then fits a circle to those edge
+// points. RANSAC throws out the rays that hit a hot pixel, or a
+// prominence, or a gap in the corona; the remaining inliers get a
+// least-squares fit. Rays stop after maxLen pixels.
+func (ll *LunarLimb)fitCircle(img image.Image, thresh uint16, maxLen float64) error {
+	edges := findLimbEdges(img, ll.LuminalCenter, thresh, maxLen)
+	if len(edges) < 10 {
+		return fmt.Errorf("only found %d edge points", len(edges))
+	}
+
+	// RANSAC; repeatedly pick three points, and see how many other
+	// points agree with the circle through them.
+	rng := rand.New(rand.NewSource(1)) // same answers every run
+	bestInliers := []limbEdge{}
+	for i:=0; i<limbRansacIters; i++ {
+		cx, cy, r, ok := circleThrough(edges[rng.Intn(len(edges))], edges[rng.Intn(len(edges))], edges[rng.Intn(len(edges))])
+		if !ok || r > maxLen {
+			continue
+		}
+		if inliers := circleInliers(edges, cx, cy, r, limbRansacInlierPx); len(inliers) > len(bestInliers) {
+			bestInliers = inliers
+		}
+	}
+	if len(bestInliers) < 10 {
+		return fmt.Errorf("no consistent circle in %d edge points", len(edges))
+	}
+
+	// Least squares fit to the inliers; then pick up any points that
+	// now agree, and fit again.
+	cx, cy, r, err := leastSquaresCircle(bestInliers)
+	if err != nil {
+		return err
+	}
+	inliers := circleInliers(edges, cx, cy, r, limbRansacInlierPx)
+	if cx, cy, r, err = leastSquaresCircle(inliers); err != nil {
+		return err
+	}
+
+	sumSq := 0.0
+	for _, e := range inliers {
+		d := math.Hypot(e.X-cx, e.Y-cy) - r
+		sumSq += d*d
+	}
+
+	ll.FitCenterX   = cx
+	ll.FitCenterY   = cy
+	ll.FitRadius    = r
+	ll.FitResidual  = math.Sqrt(sumSq / float64(len(inliers)))
+	ll.FitInliers   = len(inliers)
+	ll.FitEdgePoints = len(edges)
+
+	return nil
+}
+
+// findLimbEdges walks out along each ray, and returns the (sub-pixel)
+// point where the brightness first goes above thresh.
+func findLimbEdges(img image.Image, center image.Point, thresh uint16, maxLen float64) []limbEdge {
+	bounds := img.Bounds()
+	edges  := []limbEdge{}
+	gray   := func(x, y float64) float64 {
+		return float64(ColToGrayU16(img.At(int(math.Round(x)), int(math.Round(y)))))
+	}
+
+	for i:=0; i<limbRays; i++ {
+		theta  := 2.0 * math.Pi * float64(i) / float64(limbRays)
+		dx, dy := math.Cos(theta), math.Sin(theta)
+
+		prev := gray(float64(center.X), float64(center.Y))
+		for d:=1.0; d<maxLen; d += 1.0 {
+			x, y := float64(center.X) + d*dx, float64(center.Y) + d*dy
+			if !image.Pt(int(math.Round(x)), int(math.Round(y))).In(bounds) {
+				break
+			}
+			val := gray(x, y)
+			if val > float64(thresh) {
+				// Interpolate between the last two samples, to find where it crossed
+				frac := 0.5
+				if val > prev {
+					frac = (float64(thresh) - prev) / (val - prev)
+				}
+				d2 := d - 1.0 + frac
+				edges = append(edges, limbEdge{float64(center.X) + d2*dx, float64(center.Y) + d2*dy})
+				break
+			}
+			prev = val
+		}
+	}
+
+	return edges
+}
+
+// circleThrough returns the circle through three points; !ok if they
+// are (nearly) in a line.
+func circleThrough(a, b, c limbEdge) (float64, float64, float64, bool) {
+	d := 2.0 * (a.X*(b.Y-c.Y) + b.X*(c.Y-a.Y) + c.X*(a.Y-b.Y))
+	if math.Abs(d) < 1e-6 {
+		return 0, 0, 0, false
+	}
+	a2, b2, c2 := a.X*a.X + a.Y*a.Y, b.X*b.X + b.Y*b.Y, c.X*c.X + c.Y*c.Y
+	cx := (a2*(b.Y-c.Y) + b2*(c.Y-a.Y) + c2*(a.Y-b.Y)) / d
+	cy := (a2*(c.X-b.X) + b2*(a.X-c.X) + c2*(b.X-a.X)) / d
+	return cx, cy, math.Hypot(a.X-cx, a.Y-cy), true
+}
+
+func circleInliers(edges []limbEdge, cx, cy, r, tol float64) []limbEdge {
+	inliers := []limbEdge{}
+	for _, e := range edges {
+		if math.Abs(math.Hypot(e.X-cx, e.Y-cy) - r) < tol {
+			inliers = append(inliers, e)
+		}
+	}
+	return inliers
+}
+
+// leastSquaresCircle does an algebraic (Kasa) circle fit; it solves
+//   x^2 + y^2 + Dx + Ey + F = 0
+// for D,E,F in the least squares sense.
+func leastSquaresCircle(edges []limbEdge) (float64, float64, float64, error) {
+	A := mat.NewDense(len(edges), 3, nil)
+	b := mat.NewVecDense(len(edges), nil)
+	for i, e := range edges {
+		A.Set(i, 0, e.X)
+		A.Set(i, 1, e.Y)
+		A.Set(i, 2, 1.0)
+		b.SetVec(i, -1.0 * (e.X*e.X + e.Y*e.Y))
+	}
+
+	var x mat.VecDense
+	if err := x.SolveVec(A, b); err != nil {
+		return 0, 0, 0, fmt.Errorf("circle fit: %v", err)
+	}
+
+	cx, cy := -0.5 * x.AtVec(0), -0.5 * x.AtVec(1)
+	r2     := cx*cx + cy*cy - x.AtVec(2)
+	if r2 <= 0.0 {
+		return 0, 0, 0, fmt.Errorf("circle fit: degenerate")
+	}
+	return cx, cy, math.Sqrt(r2), nil
+}
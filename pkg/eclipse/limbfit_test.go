@@ -0,0 +1,81 @@
+package eclipse
+
+import(
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+// syntheticEclipse draws a dark (antialiased) lunar disk on a bright
+// background, with some hot pixels scattered over the disk, so that
+// some rays stop short of the limb.
+func syntheticEclipse(width, height int, cx, cy, r float64, hot []image.Point) image.Image {
+	img := image.NewGray16(image.Rect(0, 0, width, height))
+	for x:=0; x<width; x++ {
+		for y:=0; y<height; y++ {
+			cover := math.Hypot(float64(x)-cx, float64(y)-cy) - r + 0.5
+			if cover < 0.0 { cover = 0.0 }
+			if cover > 1.0 { cover = 1.0 }
+			img.SetGray16(x, y, color.Gray16{uint16(cover * 0x8000)})
+		}
+	}
+	for _, p := range hot {
+		img.SetGray16(p.X, p.Y, color.Gray16{0xFFFF})
+	}
+	return img
+}
+
+func TestLeastSquaresCircle(t *testing.T) {
+	tests := []struct{
+		cx, cy, r float64
+	}{
+		{0, 0, 1},
+		{120.5, -33.25, 87.125},
+		{1000, 2000, 5},
+	}
+
+	for _, test := range tests {
+		edges := []limbEdge{}
+		for i:=0; i<17; i++ {
+			theta := 2.0 * math.Pi * float64(i) / 17.0
+			edges = append(edges, limbEdge{test.cx + test.r*math.Cos(theta), test.cy + test.r*math.Sin(theta)})
+		}
+
+		cx, cy, r, err := leastSquaresCircle(edges)
+		if err != nil {
+			t.Errorf("circle %v: %v", test, err)
+		} else if math.Abs(cx-test.cx) > 1e-6 || math.Abs(cy-test.cy) > 1e-6 || math.Abs(r-test.r) > 1e-6 {
+			t.Errorf("circle %v: got (%f,%f) r=%f", test, cx, cy, r)
+		}
+	}
+}
+
+func TestFitCircle(t *testing.T) {
+	tests := []struct{
+		cx, cy, r float64
+		hot       []image.Point
+	}{
+		{100.0, 80.0, 50.0, nil},
+		{101.3, 79.6, 47.8, nil},
+		{90.7, 85.2, 55.5, []image.Point{{110, 85}, {70, 60}, {95, 120}, {80, 90}}},
+	}
+
+	for _, test := range tests {
+		img := syntheticEclipse(200, 170, test.cx, test.cy, test.r, test.hot)
+
+		// Start off-center, as the luminal center usually is
+		ll := LunarLimb{LuminalCenter: image.Point{int(test.cx) + 5, int(test.cy) - 3}}
+		if err := ll.fitCircle(img, 0x4000, 3.0*test.r); err != nil {
+			t.Errorf("circle (%.1f,%.1f) r=%.1f: %v", test.cx, test.cy, test.r, err)
+			continue
+		}
+
+		if math.Abs(ll.FitCenterX-test.cx) > 0.25 || math.Abs(ll.FitCenterY-test.cy) > 0.25 || math.Abs(ll.FitRadius-test.r) > 0.25 {
+			t.Errorf("circle (%.1f,%.1f) r=%.1f: got %s", test.cx, test.cy, test.r, ll)
+		}
+		if len(test.hot) > 0 && ll.FitInliers == ll.FitEdgePoints {
+			t.Errorf("circle (%.1f,%.1f) r=%.1f: no rays were rejected (%s)", test.cx, test.cy, test.r, ll)
+		}
+	}
+}
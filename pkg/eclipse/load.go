@@ -6,7 +6,9 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/rwcarlsen/goexif/exif"
 	"golang.org/x/image/tiff"
@@ -24,6 +26,19 @@ func (fi *FusedImage)LoadFilesAndDirs(args ...string) (error) {
 		return err
 	}
 
+	// Calibration frames can also be listed in the config file
+	for kind, paths := range map[calibrationKind][]string{
+		darkFrame: fi.Config.DarkFrames,
+		biasFrame: fi.Config.BiasFrames,
+		flatFrame: fi.Config.FlatFrames,
+	} {
+		for _, path := range paths {
+			if err := fi.loadCalibrationFrames(kind, path); err != nil {
+				return err
+			}
+		}
+	}
+
 	// Now everything is loaded, tidy up config
 	if len(fi.Layers) > 0 && fi.Layers[0].CameraToPCS[1] != 0.0 {
 		log.Printf("Taking CameraWhite/CameraToPCS from DNG data in %s\n", fi.Layers[0].Filename())
@@ -40,6 +55,25 @@ func (fi *FusedImage)LoadFilesAndDirs(args ...string) (error) {
 		return fmt.Errorf("No color correction info; need DNGs, or ManualOverride{AsShotNeutral,ForwardMatrix} in conf.yaml")
 	}
 
+	for model, wl := range fi.Config.WhiteLevels {
+		for _, v := range wl {
+			if v <= 0.0 || v > 1.0 {
+				return fmt.Errorf("whitelevels for '%s' is %v; each channel needs to be in (0,1]", model, wl)
+			}
+		}
+	}
+	for i := range fi.Layers {
+		l := &fi.Layers[i]
+		if wl, exists := fi.Config.WhiteLevels[l.CameraModel]; exists {
+			l.WhiteLevel = wl
+		} else if wl, exists := fi.Config.WhiteLevels["default"]; exists {
+			l.WhiteLevel = wl
+		} else {
+			continue
+		}
+		log.Printf("%s: white level for '%s' is %v\n", l.Filename(), l.CameraModel, l.WhiteLevel)
+	}
+
 	return nil
 }
 
@@ -52,6 +86,12 @@ func (fi *FusedImage)loadThings(args ...string) (error) {
 		case err != nil:
 			return fmt.Errorf("load %s: %v", arg, err)
 
+		case item.IsDir() && calibrationKindForDir(arg) != notCalibration:
+			// Is a dir of darks/biases/flats, rather than light frames
+			if err := fi.loadCalibrationFrames(calibrationKindForDir(arg), arg); err != nil {
+				return fmt.Errorf("load calibration frames %s: %v", arg, err)
+			}
+
 		case item.IsDir():
 			// Is a dir, recurse into contents
 			contents, err := ioutil.ReadDir(arg)
@@ -80,17 +120,13 @@ func (fi *FusedImage)loadFile(filename string) error {
 
 	switch strings.ToLower(ext) {
 
-	case ".tif":
-		layer, err := loadTIFF(filename)
+	case ".tif", ".dng":
+		layer, err := loadImage(filename)
 		if err != nil {
-			return fmt.Errorf("Loading %s as TIFF failed: %v", filename, err)
+			return err
 		}
-		fi.AddLayer(layer)
-
-	case ".dng":
-		layer, err := loadDNG(filename)
-		if err != nil {
-			return fmt.Errorf("Loading %s as DNG failed: %v", filename, err)
+		if err := layer.ExposureValue.Validate(); err != nil {
+			return fmt.Errorf("image '%s' Invalid EV: %v", filename, err)
 		}
 		fi.AddLayer(layer)
 
@@ -115,6 +151,28 @@ func loadConfig(filename string) (Config, error) {
 	return newConfigFromYaml(contents)
 }
 
+// loadImage loads a DNG or TIFF into a Layer. It doesn't validate the
+// exposure info, as not all images are light frames.
+func loadImage(filename string) (Layer, error) {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".tif":
+		layer, err := loadTIFF(filename)
+		if err != nil {
+			return Layer{}, fmt.Errorf("Loading %s as TIFF failed: %v", filename, err)
+		}
+		return layer, nil
+
+	case ".dng":
+		layer, err := loadDNG(filename)
+		if err != nil {
+			return Layer{}, fmt.Errorf("Loading %s as DNG failed: %v", filename, err)
+		}
+		return layer, nil
+	}
+
+	return Layer{}, fmt.Errorf("Loading %s: not a DNG or TIFF", filename)
+}
+
 func loadDNG(filename string) (Layer, error) {
 	l := Layer{LoadFilename: filename}
 
@@ -127,19 +185,21 @@ func loadDNG(filename string) (Layer, error) {
 	exposure := img.ExifExposureTime()
 
 	l.ExposureValue.ISO = img.ExifISO()
-	l.ApertureX10 = fNumberToX10(int(fnum[0]), int(fnum[1]))
+	l.FNumber = float64(fnum[0]) / float64(fnum[1])
 	l.ShutterSpeed = rat64{int64(exposure[0]), int64(exposure[1])}
 
 	l.CameraWhite = emath.Vec3(img.CameraWhite())
 	l.CameraToPCS = emath.Mat3(img.CameraToPCS())
-	
-	if err := l.ExposureValue.Validate(); err != nil {
-		return l, fmt.Errorf("image '%s' Invalid EV: %v", filename, err)
-	}
+
+	// The DNG SDK has already used the file's BlackLevel & WhiteLevel to
+	// rescale the raw data, so a saturated photosite comes out as 0xFFFF.
+	l.WhiteLevel = emath.Vec3{1.0, 1.0, 1.0}
 
 	l.LoadedImage = img
 	l.Image = l.LoadedImage // Default to no alignment (needed for first image ?) - FIXME, this is messy
 
+	loadOptionalExif(filename, &l)
+
 	return l, nil
 }
 
@@ -167,7 +227,7 @@ func loadTIFF(filename string) (Layer, error) {
 		} else if num, denom, err := tag.Rat2(0); err != nil {
 			return l, fmt.Errorf("exif FNumber '%s': %v", filename, err)
 		} else {
-			l.ApertureX10 = fNumberToX10(int(num), int(denom))
+			l.FNumber = float64(num) / float64(denom)
 		}
 
 		if tag, err := ex.Get(exif.ExposureTime); err != nil {
@@ -180,10 +240,6 @@ func loadTIFF(filename string) (Layer, error) {
 
 		// Note: we ignore Exposure Compensation, as it is informational. The
 		// Fstop/Speed/ISO triple fully defines how much light would expose a pixel.
-		
-		if err := l.ExposureValue.Validate(); err != nil {
-			return l, fmt.Errorf("image '%s' EV: %v", filename, err)
-		}
 	}
 
 	// Re-open the file, now for the image data
@@ -194,20 +250,78 @@ func loadTIFF(filename string) (Layer, error) {
 	} else {
 		l.LoadedImage = img
 		l.Image = l.LoadedImage // Default to no alignment (needed for first image ?)
+		l.WhiteLevel = emath.Vec3{1.0, 1.0, 1.0} // We can't know any better; use WhiteLevels in the config
 	}
-	
+
+	loadOptionalExif(filename, &l)
+
 	return l, nil
 }
 
-func fNumberToX10(num, denom int) int {
-	switch denom {
-	case 10: return num
-	case  5: return num * 2
-	case  1: return num * 10
-	default:
-		panic(fmt.Sprintf("exif FNumber denom unhandled '%d/%d'", num, denom))
+// loadOptionalExif picks up the EXIF metadata that we can live
+// without, so it doesn't complain if it's not there. DNGs are TIFFs
+// underneath, so this works for both.
+func loadOptionalExif(filename string, l *Layer) {
+	reader, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer reader.Close()
+
+	ex, err := exif.Decode(reader)
+	if err != nil {
+		return
+	}
+
+	rat := func(name exif.FieldName) float64 {
+		if tag, err := ex.Get(name); err != nil {
+			return 0.0
+		} else if num, denom, err := tag.Rat2(0); err != nil || denom == 0 {
+			return 0.0
+		} else {
+			return float64(num) / float64(denom)
+		}
+	}
+
+	// The camera clock is local time, without any timezone; we treat
+	// it as UTC here, and let the config sort it out.
+	if tag, err := ex.Get(exif.DateTimeOriginal); err == nil {
+		if str, err := tag.StringVal(); err == nil {
+			if t, err := time.Parse("2006:01:02 15:04:05", strings.TrimRight(str, "\x00")); err == nil {
+				if tag, err := ex.Get(exif.SubSecTimeOriginal); err == nil {
+					if sub, err := tag.StringVal(); err == nil {
+						if frac, err := strconv.ParseFloat("0."+strings.TrimSpace(strings.TrimRight(sub, "\x00")), 64); err == nil {
+							t = t.Add(time.Duration(frac * float64(time.Second)))
+						}
+					}
+				}
+				l.CameraTime = t
+			}
+		}
+	}
+
+	if tag, err := ex.Get(exif.Model); err == nil {
+		if str, err := tag.StringVal(); err == nil {
+			l.CameraModel = strings.TrimSpace(strings.TrimRight(str, "\x00"))
+		}
+	}
+
+	l.FocalLengthMM = rat(exif.FocalLength)
+
+	// FocalPlaneXResolution is pixels per unit on the sensor
+	if res := rat(exif.FocalPlaneXResolution); res > 0.0 {
+		mmPerUnit := 25.4 // 2 (the default) is inches
+		if tag, err := ex.Get(exif.FocalPlaneResolutionUnit); err == nil {
+			if unit, err := tag.Int(0); err == nil {
+				switch unit {
+				case 3: mmPerUnit = 10.0  // cm
+				case 4: mmPerUnit = 1.0   // mm
+				case 5: mmPerUnit = 0.001 // um
+				}
+			}
+		}
+		l.PixelsPerMM = res / mmPerUnit
 	}
-	return -1
 }
 
 /* Example EXIF dump from a 16-bit TIFF exported by lightroom from a DNG imported from a Nikon Df.
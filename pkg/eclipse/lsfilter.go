@@ -0,0 +1,48 @@
+package eclipse
+
+import(
+	"log"
+
+	"github.com/mdouchement/hdr/hdrcolor"
+
+	"github.com/abworrall/eclipse-hdr/pkg/lsfilter"
+)
+
+// ApplyLarsonSekanina runs a rotational gradient filter over the fused
+// HDR image, to bring out streamers and plumes. It writes the gradient
+// out as a standalone PNG, and writes an HDR image with the gradient
+// blended back in. The blended pixels also replace the fused pixels,
+// so any tonemapping done afterwards (e.g. fattal02) will include the
+// enhancement.
+//
+// It does nothing unless LarsonSekaninaAngleDeg is set.
+func (fi *FusedImage)ApplyLarsonSekanina() error {
+	if fi.Config.LarsonSekaninaAngleDeg == 0.0 {
+		return nil
+	}
+
+	center, _ := fi.LunarLimbInOutputArea()
+	op := lsfilter.NewDefaultLarsonSekanina(fi, center)
+	op.AngleDeg    = fi.Config.LarsonSekaninaAngleDeg
+	op.RadialShift = fi.Config.LarsonSekaninaRadialShift
+
+	log.Printf("Larson-Sekanina filter: %.2fdeg, %.1fpx (blend %.2f)\n",
+		op.AngleDeg, op.RadialShift, fi.Config.LarsonSekaninaBlend)
+
+	if err := WritePNG(op.Perform(), "larson-sekanina.png"); err != nil {
+		return err
+	}
+
+	blended := op.Blended(fi.Config.LarsonSekaninaBlend)
+	if err := WriteHDR(blended, "larson-sekanina.hdr", fi.HDRComments()...); err != nil {
+		return err
+	}
+
+	for x:=0; x<fi.Bounds().Dx(); x++ {
+		for y:=0; y<fi.Bounds().Dy(); y++ {
+			fi.setRGB(fi.index(x, y), blended.HDRAt(x, y).(hdrcolor.RGB))
+		}
+	}
+
+	return nil
+}
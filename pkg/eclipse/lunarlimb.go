@@ -1,10 +1,12 @@
 package eclipse
 
 import(
+	"fmt"
 	"image"
 	"image/color"
 	"log"
 	"math"
+	"sort"
 )
 
 // The LunarLimb is the shadow/outline of the moon. We identify it and
@@ -13,10 +15,52 @@ type LunarLimb struct {
 	LuminalCenter image.Point // The luminance-weighted "center" of the image. Hopefully will be inside the limb.
 	Brightness uint16         // A rough average of the brightness of the pixels in the limb (floodfill needs to know this)
 	Bounds image.Rectangle    // A box around the limb
+
+	// A circle fitted to the edge of the limb; if FitRadius is zero,
+	// the fit failed, and we fall back to the bounding box.
+	FitCenterX    float64
+	FitCenterY    float64
+	FitRadius     float64
+	FitResidual   float64     // RMS distance of the edge points from the circle, in pixels
+	FitInliers    int         // How many edge points were used in the fit ...
+	FitEdgePoints int         // ... out of how many found
+}
+
+func (ll LunarLimb)IsFitted() bool { return ll.FitRadius > 0.0 }
+
+// PreciseCenter returns the sub-pixel center of the limb.
+func (ll LunarLimb)PreciseCenter() (float64, float64) {
+	if ll.IsFitted() {
+		return ll.FitCenterX, ll.FitCenterY
+	}
+	c := RectCenter(ll.Bounds)
+	return float64(c.X), float64(c.Y)
+}
+
+// PreciseRadius returns the sub-pixel radius of the limb.
+func (ll LunarLimb)PreciseRadius() float64 {
+	if ll.IsFitted() {
+		return ll.FitRadius
+	}
+	return float64(ll.Bounds.Dx() + ll.Bounds.Dy()) / 4.0
 }
 
-func (ll LunarLimb)Radius() int { return (ll.Bounds.Dx() + ll.Bounds.Dy())/4 }
-func (ll LunarLimb)Center() image.Point { return RectCenter(ll.Bounds) }
+func (ll LunarLimb)Radius() int { return int(math.Round(ll.PreciseRadius())) }
+func (ll LunarLimb)Center() image.Point {
+	x, y := ll.PreciseCenter()
+	return image.Point{int(math.Round(x)), int(math.Round(y))}
+}
+
+func (ll LunarLimb)String() string {
+	x, y := ll.PreciseCenter()
+	str := fmt.Sprintf("Limb[(%.2f,%.2f) r=%.2f", x, y, ll.PreciseRadius())
+	if ll.IsFitted() {
+		str += fmt.Sprintf(", resid %.2fpx, %d/%d edge pts", ll.FitResidual, ll.FitInliers, ll.FitEdgePoints)
+	} else {
+		str += ", bounding box"
+	}
+	return str + "]"
+}
 
 func (ll *LunarLimb)Grow(p image.Point) {
 	if ll.Bounds.Max.X == 0 {
@@ -31,8 +75,13 @@ func (ll *LunarLimb)Grow(p image.Point) {
 // outline of the moon. This is a fairly dumb routine; it finds the
 // centroid of all the luminance in the image, assumes that is inside
 // the lunar limb, and then floodfills out until it sees some
-// bright pixels.
-func FindLunarLimb(cfg Config, img image.Image) LunarLimb {
+// bright pixels. It then fits a circle to the edge, for a more precise
+// center & radius.
+//
+// It needs the limb to be fully enclosed by corona; if there is a gap
+// (diamond ring, partial phases), the flood escapes, and it returns an
+// error.
+func FindLunarLimb(cfg Config, img image.Image) (LunarLimb, error) {
 	ll := LunarLimb{}
 	p := image.Point{}
 	bounds := img.Bounds()
@@ -91,15 +140,104 @@ func FindLunarLimb(cfg Config, img image.Image) LunarLimb {
 	}
 	
 	dci.PlotRectangle(ll.Bounds)
+
+	if ll.Radius() == 0 {
+		return ll, fmt.Errorf("floodfill: could not locate lunar limb")
+	} else if ll.Bounds.Min.X <= bounds.Min.X || ll.Bounds.Min.Y <= bounds.Min.Y || ll.Bounds.Max.X >= bounds.Max.X-1 || ll.Bounds.Max.Y >= bounds.Max.Y-1 {
+		return ll, fmt.Errorf("floodfill: leaked out to the edge of the image, %s", ll.Bounds)
+	}
+
+	if err := ll.fitCircle(img, thresh, 2.0 * float64(ll.Radius()) + 10.0); err != nil {
+		if aspect := float64(ll.Bounds.Dx()) / float64(ll.Bounds.Dy()); aspect < 0.8 || aspect > 1.25 {
+			return ll, fmt.Errorf("floodfill: circle fit failed (%v), and %s isn't very round", err, ll.Bounds)
+		}
+		log.Printf("Lunar limb circle fit failed (%v), using bounding box\n", err)
+	} else {
+		dci.PlotCircle(ll.FitCenterX, ll.FitCenterY, ll.FitRadius)
+	}
+	log.Printf("Found lunar limb: %s\n", ll)
+
 	if cfg.Verbosity > 0 {
 		dci.Flush()
 	}
 
-	if ll.Radius() == 0 {
-		log.Fatal("Could not locate lunar limb, stopping\n")
+	return ll, nil
+}
+
+// FindLunarLimbs finds the lunar limb in each layer. Any layers where
+// the floodfill doesn't work get another try with the Hough detector,
+// which needs to know roughly how big the moon is; we take that from
+// the config, or the layers that did work, or the focal length.
+func (fi *FusedImage)FindLunarLimbs() error {
+	failed := []int{}
+
+	switch fi.Config.LimbFinder {
+	case "floodfill", "":
+		for i:=0; i<len(fi.Layers); i++ {
+			ll, err := FindLunarLimb(fi.Config, fi.Layers[i].LoadedImage)
+			if err != nil {
+				log.Printf("%s: %v; will try hough\n", fi.Layers[i].Filename(), err)
+				failed = append(failed, i)
+				continue
+			}
+			fi.Layers[i].LunarLimb = ll
+		}
+	case "hough":
+		for i:=0; i<len(fi.Layers); i++ {
+			failed = append(failed, i)
+		}
+	default:
+		return fmt.Errorf("no LimbFinder strategy named %q", fi.Config.LimbFinder)
 	}
-	
-	return ll
+
+	if len(failed) == 0 {
+		return nil
+	}
+
+	radius, source := fi.expectedLunarRadius(failed)
+	log.Printf("Hough lunar limb search, expecting a radius of %.1f pixels (from %s)\n", radius, source)
+
+	for _, i := range failed {
+		ll, err := FindLunarLimbHough(fi.Config, fi.Layers[i].LoadedImage, radius)
+		if err != nil {
+			return fmt.Errorf("%s: could not locate lunar limb: %v", fi.Layers[i].Filename(), err)
+		}
+		log.Printf("Found lunar limb: %s\n", ll)
+		fi.Layers[i].LunarLimb = ll
+	}
+
+	return nil
+}
+
+// expectedLunarRadius figures out how big the moon should be, for the
+// layers that still need their limb finding.
+func (fi *FusedImage)expectedLunarRadius(todo []int) (float64, string) {
+	if fi.Config.LunarRadiusPix > 0.0 {
+		return fi.Config.LunarRadiusPix, "config"
+	}
+
+	isTodo := map[int]bool{}
+	for _, i := range todo {
+		isTodo[i] = true
+	}
+	radii := []float64{}
+	for i:=0; i<len(fi.Layers); i++ {
+		if !isTodo[i] {
+			radii = append(radii, fi.Layers[i].LunarLimb.PreciseRadius())
+		}
+	}
+	if len(radii) > 0 {
+		sort.Float64s(radii)
+		return radii[len(radii)/2], fmt.Sprintf("%d other layers", len(radii))
+	}
+
+	for _, i := range todo {
+		if r := fi.Layers[i].ExpectedLunarRadius(); r > 0.0 {
+			return r, fmt.Sprintf("focal length of %s", fi.Layers[i].Filename())
+		}
+	}
+
+	return 0.0, "nowhere"
 }
 
 // computeLuminalCenter finds the 'centre of mass' for the image
@@ -209,6 +347,14 @@ func (dci *debugCompositeImage)PlotRectangle(r image.Rectangle) {
 	}
 }
 
+func (dci *debugCompositeImage)PlotCircle(cx, cy, r float64) {
+	col := dci.PickColor()
+	for i:=0; i<3600; i++ {
+		theta := 2.0 * math.Pi * float64(i) / 3600.0
+		dci.fillMap.Set(int(math.Round(cx + r*math.Cos(theta))), int(math.Round(cy + r*math.Sin(theta))), col)
+	}
+}
+
 func (dci *debugCompositeImage)PlotMarker(p image.Point) {
 	dci.PlotRectangle(image.Rectangle{image.Point{p.X-2, p.Y-2}, image.Point{p.X+2, p.Y+2}})
 	dci.PlotRectangle(image.Rectangle{image.Point{p.X-4, p.Y-4}, image.Point{p.X+4, p.Y+4}})
@@ -0,0 +1,98 @@
+package eclipse
+
+import(
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/abworrall/eclipse-hdr/pkg/emath"
+)
+
+// NorthAngle returns where north is in the reference layer, as an angle
+// (degrees, clockwise) from the top of the image. The camera is
+// assumed to be on an alt-az mount (e.g. a tripod), so the top of the
+// image is towards the zenith, unless the camera was rolled.
+func (fi *FusedImage)NorthAngle() (float64, error) {
+	cfg := fi.Config
+	if cfg.ObserverLatitude == 0.0 && cfg.ObserverLongitude == 0.0 {
+		return 0.0, fmt.Errorf("need observerlatitude & observerlongitude to find north")
+	} else if len(fi.Layers) == 0 || fi.RefLayer().CameraTime.IsZero() {
+		return 0.0, fmt.Errorf("need a DateTimeOriginal timestamp in the reference layer to find north")
+	}
+
+	t := fi.RefLayer().CameraTime.Add(-1 * time.Duration(cfg.CameraUTCOffsetHours * float64(time.Hour)))
+
+	// The zenith is at an angle of -roll in the image; celestial north
+	// is the parallactic angle clockwise from that, and solar north is
+	// the P angle anticlockwise from celestial north.
+	angle := SunParallacticAngle(t, cfg.ObserverLatitude, cfg.ObserverLongitude) - cfg.CameraRollDeg
+
+	switch cfg.OrientNorth {
+	case "celestial":
+	case "solar":
+		angle -= SunPAngle(t)
+	default:
+		return 0.0, fmt.Errorf("no OrientNorth named '%s'", cfg.OrientNorth)
+	}
+
+	return math.Mod(angle + 540.0, 360.0) - 180.0, nil
+}
+
+// OrientNorthUp rotates the fused image (about the center of the moon)
+// so that north is up. It records how far it rotated the image in
+// OutputRotationDeg.
+func (fi *FusedImage)OrientNorthUp() error {
+	if fi.Config.OrientNorth == "" {
+		return nil
+	}
+
+	north, err := fi.NorthAngle()
+	if err != nil {
+		return fmt.Errorf("orient %s north up: %v", fi.Config.OrientNorth, err)
+	}
+
+	cx, cy := float64(fi.OutputArea.Dx()) / 2.0, float64(fi.OutputArea.Dy()) / 2.0
+	if fi.Config.DoEclipseAlignment && len(fi.Layers) > 0 && fi.RefLayer().LunarLimb.Radius() > 0 {
+		cx, cy = fi.RefLayer().LunarLimb.PreciseCenter()
+		cx -= float64(fi.InputArea.Min.X)
+		cy -= float64(fi.InputArea.Min.Y)
+	}
+
+	log.Printf("Rotating output by %.3fdeg, to put %s north up\n", -1*north, fi.Config.OrientNorth)
+
+	// For each output pixel, find where it comes from in the unrotated
+	// image. The color is interpolated; everything else (which is only
+	// really there for debugging) is taken from the nearest pixel.
+	m    := emath.RotateAbout(north, cx, cy)
+	w, h := fi.OutputArea.Dx(), fi.OutputArea.Dy()
+	R, G, B := make([]float32, w*h), make([]float32, w*h), make([]float32, w*h)
+	layerNumber, numClipped, numGhosted := make([]uint8, w*h), make([]uint8, w*h), make([]uint8, w*h)
+	for x:=0; x<w; x++ {
+		for y:=0; y<h; y++ {
+			sx, sy := m.Apply(float64(x), float64(y))
+			x0, y0 := int(math.Floor(sx)), int(math.Floor(sy))
+			if x0 < 0 || y0 < 0 || x0 >= w-1 || y0 >= h-1 {
+				continue
+			}
+
+			i, j := fi.index(x, y), fi.index(int(math.Round(sx)), int(math.Round(sy)))
+			layerNumber[i], numClipped[i], numGhosted[i] = fi.LayerNumber[j], fi.NumClipped[j], fi.NumGhosted[j]
+
+			fx, fy := sx - float64(x0), sy - float64(y0)
+			i00, i10 := fi.index(x0, y0), fi.index(x0+1, y0)
+			i01, i11 := fi.index(x0, y0+1), fi.index(x0+1, y0+1)
+			lerp := func(plane []float32) float32 {
+				v00, v10, v01, v11 := float64(plane[i00]), float64(plane[i10]), float64(plane[i01]), float64(plane[i11])
+				return float32((v00*(1-fx) + v10*fx)*(1-fy) + (v01*(1-fx) + v11*fx)*fy)
+			}
+			R[i], G[i], B[i] = lerp(fi.R), lerp(fi.G), lerp(fi.B)
+		}
+	}
+
+	fi.R, fi.G, fi.B = R, G, B
+	fi.LayerNumber, fi.NumClipped, fi.NumGhosted = layerNumber, numClipped, numGhosted
+	fi.Config.OutputRotationDeg = -1 * north
+
+	return nil
+}
@@ -0,0 +1,89 @@
+package eclipse
+
+import(
+	"image"
+	"math"
+	"testing"
+	"time"
+)
+
+// centroid returns the brightness-weighted center of the red plane.
+func (fi *FusedImage)centroid() (float64, float64) {
+	sum, sx, sy := 0.0, 0.0, 0.0
+	for x:=0; x<fi.OutputArea.Dx(); x++ {
+		for y:=0; y<fi.OutputArea.Dy(); y++ {
+			v := float64(fi.R[fi.index(x, y)])
+			sum += v
+			sx  += v * float64(x)
+			sy  += v * float64(y)
+		}
+	}
+	return sx/sum, sy/sum
+}
+
+// Put a dot where north is in the image, and check that orienting the
+// image moves it straight up; and that the recorded rotation, used as
+// an AlignmentTransform, does the same.
+func TestOrientNorthUp(t *testing.T) {
+	const w, h, d = 121, 101, 30.0
+	cx, cy := w / 2.0, h / 2.0
+
+	tests := []struct{
+		north     string
+		hour, min int
+		rollDeg   float64
+		expected  float64 // where north is, clockwise from up
+	}{
+		{"celestial", 14,  0,  0.0, -57.49},
+		{"celestial", 23,  0,  0.0,  57.59},
+		{"celestial", 14,  0, 10.0, -67.49},
+		{"solar",     18, 42,  0.0,  32.70},  // 6.47 + 26.23
+	}
+
+	for _, test := range tests {
+		fi := NewFusedImage()
+		fi.OutputArea           = image.Rect(0, 0, w, h)
+		fi.OrientNorth          = test.north
+		fi.ObserverLatitude     = testLat
+		fi.ObserverLongitude    = testLon
+		fi.CameraRollDeg        = test.rollDeg
+		fi.DoEclipseAlignment   = false
+		fi.Layers = []Layer{{CameraTime: time.Date(2024, time.April, 8, test.hour, test.min, 0, 0, time.UTC)}}
+
+		north, err := fi.NorthAngle()
+		if err != nil {
+			t.Errorf("%s north at %02d:%02d: %v", test.north, test.hour, test.min, err)
+			continue
+		} else if math.Abs(north - test.expected) > 0.05 {
+			t.Errorf("%s north at %02d:%02d: got %.3fdeg, expected %.2fdeg", test.north, test.hour, test.min, north, test.expected)
+		}
+
+		// With y pointing down, `north` degrees clockwise from up
+		dotX := cx + d*math.Sin(north * math.Pi / 180.0)
+		dotY := cy - d*math.Cos(north * math.Pi / 180.0)
+
+		fi.R, fi.G, fi.B = make([]float32, w*h), make([]float32, w*h), make([]float32, w*h)
+		fi.LayerNumber, fi.NumClipped, fi.NumGhosted = make([]uint8, w*h), make([]uint8, w*h), make([]uint8, w*h)
+		for x:=0; x<w; x++ {
+			for y:=0; y<h; y++ {
+				d2 := (float64(x)-dotX)*(float64(x)-dotX) + (float64(y)-dotY)*(float64(y)-dotY)
+				fi.R[fi.index(x, y)] = float32(math.Exp(-d2 / (2.0 * 1.5*1.5)))
+			}
+		}
+
+		if err := fi.OrientNorthUp(); err != nil {
+			t.Errorf("%s north at %02d:%02d: %v", test.north, test.hour, test.min, err)
+			continue
+		}
+
+		if x, y := fi.centroid(); math.Abs(x - cx) > 0.3 || math.Abs(y - (cy-d)) > 0.3 {
+			t.Errorf("%s north at %02d:%02d: dot ended up at (%.2f,%.2f), not (%.2f,%.2f)", test.north, test.hour, test.min, x, y, cx, cy-d)
+		}
+
+		xform := AlignmentTransform{RotateByDeg: fi.OutputRotationDeg, RotationCenterX: cx, RotationCenterY: cy}
+		if x, y := xform.ToMatrix().Apply(dotX, dotY); math.Abs(x - cx) > 1e-6 || math.Abs(y - (cy-d)) > 1e-6 {
+			t.Errorf("%s north at %02d:%02d: OutputRotationDeg=%.3f maps the dot to (%.2f,%.2f), not (%.2f,%.2f)",
+				test.north, test.hour, test.min, fi.OutputRotationDeg, x, y, cx, cy-d)
+		}
+	}
+}
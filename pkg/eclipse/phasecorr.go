@@ -0,0 +1,86 @@
+package eclipse
+
+import(
+	"image"
+	"image/color"
+	"log"
+	"math"
+
+	"github.com/abworrall/eclipse-hdr/pkg/emath"
+)
+
+// AlignLayerPhaseCorrelation finetunes the translation part of the
+// alignment, using FFT phase correlation over the log luminance of the
+// InputArea. It takes seconds, rather than the hours that
+// AlignLayerFine needs, but doesn't look at rotation.
+func AlignLayerPhaseCorrelation(cfg Config, l1, l2 *Layer, baseXform AlignmentTransform) (AlignmentTransform, error) {
+	evMax, lo, hi := commonLuminanceRange(cfg, l1, l2)
+	g1 := phaseCorrGrid(cfg, l1.Image, l1.ExposureValue, evMax, lo, hi)
+
+	log.Printf("Align phasecorr:\n")
+	log.Printf(" -- orig  : %s\n", baseXform)
+
+	// The first pass gets us to within a fraction of a pixel; a second
+	// pass over the re-aligned image mops up what's left.
+	best := baseXform
+	for pass:=1; pass<=2; pass++ {
+		g2 := phaseCorrGrid(cfg, best.XFormImage(l2.LoadedImage), l2.ExposureValue, evMax, lo, hi)
+		dx, dy, peak := emath.PhaseCorrelate(g1, g2)
+
+		if peak < 0.02 {
+			log.Printf(" -- pass%d : no clear correlation peak (%.3f), giving up\n", pass, peak)
+			break
+		}
+
+		best.TranslateByX += dx
+		best.TranslateByY += dy
+		log.Printf(" -- pass%d : %s (shift by %.2f,%.2f; peak %.3f)\n", pass, best, dx, dy, peak)
+	}
+
+	errMetric, err := ImgDiff(cfg, l1, l2, "phasecorr", best)
+	if err != nil {
+		return baseXform, err
+	}
+	best.ErrorMetric = errMetric
+
+	log.Printf("Align phasecorr: orig  %s\n", baseXform)
+	log.Printf("Align phasecorr: final %s\n", best)
+	return best, nil
+}
+
+// commonLuminanceRange returns the luminance range (normalized to
+// evMax, the larger of the two illuminances at max exposure) that both
+// layers can see. Both images need to be clamped to it, else the edges
+// of the saturated (or noisy) regions will look like features, and
+// they don't line up.
+func commonLuminanceRange(cfg Config, l1, l2 *Layer) (ExposureValue, float64, float64) {
+	evMax := l1.ExposureValue
+	if l2.IlluminanceAtMaxExposure > evMax.IlluminanceAtMaxExposure {
+		evMax = l2.ExposureValue
+	}
+
+	lo := math.Max(col2Y(cfg, grayPix(0x0200), l1.ExposureValue, evMax), col2Y(cfg, grayPix(0x0200), l2.ExposureValue, evMax))
+	hi := math.Min(col2Y(cfg, grayPix(0x8000), l1.ExposureValue, evMax), col2Y(cfg, grayPix(0x8000), l2.ExposureValue, evMax))
+	return evMax, lo, hi
+}
+
+func grayPix(v uint16) color.Color {
+	return color.RGBA64{v, v, v, 0xFFFF}
+}
+
+// phaseCorrGrid builds a grid of log luminance over the InputArea,
+// normalized to evMax, and clamped to [lo,hi].
+func phaseCorrGrid(cfg Config, img image.Image, ev, evMax ExposureValue, lo, hi float64) emath.FloatGrid {
+	bounds := cfg.InputArea
+	grid   := emath.NewFloatGrid(bounds.Dx(), bounds.Dy())
+
+	for x:= bounds.Min.X; x<bounds.Max.X; x++ {
+		for y:= bounds.Min.Y; y<bounds.Max.Y; y++ {
+			Y := col2Y(cfg, img.At(x, y), ev, evMax)
+			Y  = math.Max(lo, math.Min(hi, Y))
+			grid.Set(x-bounds.Min.X, y-bounds.Min.Y, math.Log(Y))
+		}
+	}
+
+	return grid
+}
@@ -13,6 +13,29 @@ import(
 // - DevelopBy: perform color correction to the HDR pixel prior to tonemapping
 type PixelFunc func(Config, *Pixel)
 
+// rejected says whether layer i's sample was clipped, or a ghost.
+func (p *Pixel)rejected(i int) bool {
+	return (i < len(p.Clipped) && p.Clipped[i]) || (i < len(p.Ghosted) && p.Ghosted[i])
+}
+
+// lastUsable returns the least exposed layer that wasn't rejected; the
+// fusers fall back to it when all the others look too exposed. If
+// every layer was rejected, it's just the least exposed layer.
+func (p *Pixel)lastUsable() int {
+	for i:=len(p.In)-1; i>=0; i-- {
+		if !p.rejected(i) {
+			return i
+		}
+	}
+	return len(p.In)-1
+}
+
+// usable says whether the fusers should consider layer i; rejected
+// samples are skipped (unless there is nothing else).
+func (p *Pixel)usable(i int) bool {
+	return !p.rejected(i) || i == p.lastUsable()
+}
+
 // FuseByPickMostExposed is the default algorithm for image fusion:
 // look for the image that is most-exposed (i.e. has received the most
 // photons and will thus have lowest noise), but not over-exposed at
@@ -24,9 +47,16 @@ func FuseByPickMostExposed(cfg Config, p *Pixel) {
 
 	// The images are pre-sorted in asc EV with the largest exposures
 	// (most photons, least noise) first, so stop as soon as we can
-	for i:=0; i<len(p.In); i++ {
+	last := p.lastUsable()
+	for i:=0; i<=last; i++ {
+		// A single clipped channel can leave Y under maxY, but the color
+		// would still be wrong.
+		if !p.usable(i) {
+			continue
+		}
+
 		// If this looks too exposed, and we can move on to another layer, move on.
-		if i < len(p.In)-1 {
+		if i < last {
 			_, Y, _, _ := p.In[i].HDRXYZA()
 			if Y > maxY {
 				continue
@@ -40,6 +70,63 @@ func FuseByPickMostExposed(cfg Config, p *Pixel) {
 	}
 }
 
+// FuseByFeathering is FuseByPickMostExposed with soft edges. Rather
+// than switching to the next layer as soon as a layer goes over
+// FuserLuminance, it fades from one to the next over a ramp of
+// FuserFeatherWidth (in luminance), so there are no contour lines
+// where the layers meet.
+//
+// Each layer, most exposed first, takes a share of the pixel based on
+// where its luminance is on the ramp; whatever is left over goes to
+// the next layer.
+func FuseByFeathering(cfg Config, p *Pixel) {
+	maxY  := cfg.FuserLuminance
+	width := math.Max(cfg.FuserFeatherWidth, 1e-6)
+
+	ramp := func(Y float64) float64 {
+		t := math.Max(0.0, math.Min(1.0, (maxY - Y) / width))
+		return t*t*(3.0 - 2.0*t) // smoothstep
+	}
+
+	maxIllum := 0.0
+	for i:=0; i<len(p.In); i++ {
+		if p.In[i].IllumAtMax > maxIllum { maxIllum = p.In[i].IllumAtMax }
+	}
+
+	fused := ecolor.CameraNative{IllumAtMax: maxIllum}
+	remaining, biggest := 1.0, 0.0
+
+	last := p.lastUsable()
+	for i:=0; i<=last && remaining > 0.0; i++ {
+		if !p.usable(i) {
+			continue // pass its share on to the next layer
+		}
+
+		share := remaining
+		if i < last {
+			_, Y, _, _ := p.In[i].HDRXYZA()
+			share = remaining * ramp(Y)
+		}
+		if share <= 0.0 {
+			continue
+		}
+
+		// Normalize to the same EV before mixing
+		r, g, b, _ := p.In[i].HDRRGBA()
+		scale := p.In[i].IllumAtMax / maxIllum
+		fused.RGB.R += share * r * scale
+		fused.RGB.G += share * g * scale
+		fused.RGB.B += share * b * scale
+
+		if share > biggest {
+			p.LayerNumber, biggest = i, share
+		}
+		remaining -= share
+	}
+
+	p.Fused = fused
+}
+
 // FuseBySector cuts up the image into pie slices, and simply picks
 // a source layer based on which pie segment the pixel lies inside.
 // It's useful for comparing the source images to see how well
@@ -66,9 +153,14 @@ func FuseByAverage(cfg Config, p *Pixel) {
 	toAvg := []ecolor.CameraNative{}
 
 	// The images are pre-sorted in asc EV; slowest exposures first, most likely to over-expose.
-	for i:=0; i<len(p.In); i++ {
+	last := p.lastUsable()
+	for i:=0; i<=last; i++ {
+		if !p.usable(i) {
+			continue
+		}
+
 		// If this looks too exposed, and we have less-exposed layers left, move on.
-		if i < len(p.In)-1 {
+		if i < last {
 			r, g, b, _ := p.In[i].HDRRGBA()
 			if r > max || g > max || b > max {
 				continue
@@ -82,6 +174,69 @@ func FuseByAverage(cfg Config, p *Pixel) {
 	p.LayerNumber = len(toAvg)
 }
 
+// FuseByWeightedAverage is a Debevec-style radiance merge; rather
+// than picking one layer, it combines every layer, weighting each
+// one by how much we trust it at this pixel. The weight is a "hat"
+// function of the sensor reading, peaking in the middle of the usable
+// range [0, FuserLuminance], and falling to zero for very dark (noisy)
+// or near-saturated readings. It is then scaled by the exposure, so
+// that longer exposures (more photons, relatively less shot noise)
+// count for more.
+//
+// The hat uses the brightest channel, so a layer with any channel
+// approaching saturation gets dropped entirely, instead of shifting
+// the color.
+func FuseByWeightedAverage(cfg Config, p *Pixel) {
+	max := cfg.FuserLuminance
+
+	hat := func(v float64) float64 {
+		if v <= 0.0 || v >= max {
+			return 0.0
+		}
+		return 1.0 - math.Abs(2.0*v/max - 1.0)
+	}
+
+	maxIllum := 0.0
+	for i:=0; i<len(p.In); i++ {
+		if p.In[i].IllumAtMax > maxIllum { maxIllum = p.In[i].IllumAtMax }
+	}
+
+	fused := ecolor.CameraNative{IllumAtMax: maxIllum}
+	totWeight := 0.0
+	nUsed := 0
+
+	for i:=0; i<len(p.In); i++ {
+		r, g, b, _ := p.In[i].HDRRGBA()
+		brightest := math.Max(r, math.Max(g, b))
+
+		// IllumAtMax is inversely proportional to exposure
+		weight := hat(brightest) * (maxIllum / p.In[i].IllumAtMax)
+		if weight <= 0.0 || p.rejected(i) {
+			continue
+		}
+
+		scale := p.In[i].IllumAtMax / maxIllum
+		fused.RGB.R += weight * r * scale
+		fused.RGB.G += weight * g * scale
+		fused.RGB.B += weight * b * scale
+		totWeight += weight
+		nUsed++
+	}
+
+	// Nothing usable (e.g. black sky, or saturated in every layer); fall back to a single layer
+	if totWeight == 0.0 {
+		FuseByPickMostExposed(cfg, p)
+		return
+	}
+
+	fused.RGB.R /= totWeight
+	fused.RGB.G /= totWeight
+	fused.RGB.B /= totWeight
+
+	p.Fused = fused
+	p.LayerNumber = nUsed
+}
+
 // DevelopDNG follows the DNG spec's algorithm for mapping a
 // CameraNative sensor reading into a camera-neutral XYZ(D50) color,
 // and then into a standard sRGB(D65) output color. This requires
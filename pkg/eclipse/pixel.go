@@ -10,18 +10,41 @@ import(
 	"github.com/abworrall/eclipse-hdr/pkg/ecolor"
 )
 
+// A Pixel holds everything about one pixel, while it's being fused and
+// developed. Fuse only keeps the results (in the FusedImage's planes),
+// apart from the DebugPixels, which get dumped in full.
 type Pixel struct {
 	OutputPos     image.Point                        // In output coords
 	RawInputs   []color.Color
 	In          []ecolor.CameraNative
+	Clipped     []bool                               // Whether each layer's sample is at the white level (in any channel)
+	Ghosted     []bool                               // Whether each layer's sample disagrees with the other layers
 
 	Fused         ecolor.CameraNative                // The single CameraNative pixel fused from the source images
 	DevelopedRGB  hdrcolor.RGB                       // The white balanced, color-corrected HDR RGB value
-	TonemappedRGB color.Color                        // The final LDR output, after HDR->LDR tonemapping
 
 	LayerNumber   int                                // which layer used; or how many layers used
 }
 
+// AllClipped is true if there was no layer that wasn't clipped.
+func (p Pixel)AllClipped() bool {
+	for _, clipped := range p.Clipped {
+		if !clipped {
+			return false
+		}
+	}
+	return len(p.Clipped) > 0
+}
+
+// NumGhosted is how many layers were rejected as ghosts.
+func (p Pixel)NumGhosted() int {
+	n := 0
+	for _, ghosted := range p.Ghosted {
+		if ghosted { n++ }
+	}
+	return n
+}
+
 func (p Pixel)String() string {
 	str := fmt.Sprintf("----- Pixel @(%d,%d)-----\n", p.OutputPos.X, p.OutputPos.Y)
 
@@ -33,7 +56,14 @@ func (p Pixel)String() string {
 
 	str += fmt.Sprintf("CameraNative  Inputs:-\n")
 	for i:=0; i<len(p.In); i++ {
-		str += fmt.Sprintf("-- layer %d         : %s\n", i, p.In[i])
+		str += fmt.Sprintf("-- layer %d         : %s", i, p.In[i])
+		if i < len(p.Clipped) && p.Clipped[i] {
+			str += " CLIPPED"
+		}
+		if i < len(p.Ghosted) && p.Ghosted[i] {
+			str += " GHOST"
+		}
+		str += "\n"
 	}
 	str += fmt.Sprintf("\n")
 
@@ -41,12 +71,6 @@ func (p Pixel)String() string {
 	str += fmt.Sprintf("DevelopedRGB       : [%12.10f, %12.10f, %12.10f]\n",
 		p.DevelopedRGB.R, p.DevelopedRGB.G, p.DevelopedRGB.B)
 
-	if p.TonemappedRGB != nil {
-		r, g, b, _ := p.TonemappedRGB.RGBA()
-		str += fmt.Sprintf("Output(RGB64)      : [      0x%04X,       0x%04X,       0x%04X]\n", r, g, b)
-		r, g, b = r>>8, g>>8, b>>8
-		str += fmt.Sprintf("Output(RGB32)      : [%12d, %12d, %12d]\n", r, g, b)
-	}
 	str += fmt.Sprintf("\n")
 
 	return str
@@ -0,0 +1,77 @@
+package eclipse
+
+import(
+	"image"
+	"math"
+
+	"github.com/abworrall/eclipse-hdr/pkg/emath"
+)
+
+// A lumPyramid is a stack of luminance grids, each half the size of
+// the one before, for doing coarse-to-fine searches. Pixels that
+// aren't well exposed are NaN, and stay NaN as they get averaged into
+// the coarser levels, so they never get compared.
+type lumPyramid struct {
+	Origin image.Point       // Where the full-res grid starts, in image coords
+	Levels []emath.FloatGrid // Levels[0] is full res
+}
+
+// newLumPyramid builds a pyramid over `bounds` of the image, with
+// luminance normalized to evMax (as per ImgDiff).
+func newLumPyramid(cfg Config, img image.Image, ev, evMax ExposureValue, bounds image.Rectangle, nLevels int) lumPyramid {
+	grid := emath.NewFloatGrid(bounds.Dx(), bounds.Dy())
+	for x:= bounds.Min.X; x<bounds.Max.X; x++ {
+		for y:= bounds.Min.Y; y<bounds.Max.Y; y++ {
+			c := img.At(x, y)
+			val := math.NaN()
+			if exposureOf(c) == wellExposed {
+				val = col2Y(cfg, c, ev, evMax)
+			}
+			grid.Set(x-bounds.Min.X, y-bounds.Min.Y, val)
+		}
+	}
+
+	p := lumPyramid{Origin: bounds.Min, Levels: []emath.FloatGrid{grid}}
+	for i:=1; i<nLevels; i++ {
+		p.Levels = append(p.Levels, p.Levels[i-1].DownSample())
+	}
+	return p
+}
+
+// At returns the luminance at a fractional location (in full-res image
+// coords), from the given level. Returns NaN if outside the grid.
+func (p lumPyramid)At(level int, x, y float64) float64 {
+	g     := &p.Levels[level]
+	scale := float64(int(1) << uint(level))
+
+	// The center of pixel (i,j) at this level is at full-res (i+0.5)*scale-0.5
+	gx := (x - float64(p.Origin.X) + 0.5) / scale - 0.5
+	gy := (y - float64(p.Origin.Y) + 0.5) / scale - 0.5
+	if gx < 0.0 || gy < 0.0 || gx > float64(g.Dx()-1) || gy > float64(g.Dy()-1) {
+		return math.NaN()
+	}
+	return g.Interpolate(gx, gy)
+}
+
+// Diff is the pyramid version of ImgDiff; it compares p1 (the base
+// layer) against p2 (a later layer, in its original coords), after
+// transforming p2 by xform, using the given metric. It is much cheaper
+// than ImgDiff, as it never renders the whole transformed image; it
+// just looks up the pixels it needs.
+func (p1 lumPyramid)Diff(p2 lumPyramid, level int, xform AlignmentTransform, metric AlignmentMetric) float64 {
+	g1    := &p1.Levels[level]
+	g2    := g1.NewFromThis()
+	scale := float64(int(1) << uint(level))
+	inv   := xform.ToMatrix().Invert() // maps base layer coords back into the later layer
+
+	for i:=0; i<g1.Dx(); i++ {
+		for j:=0; j<g1.Dy(); j++ {
+			x := float64(p1.Origin.X) + (float64(i)+0.5)*scale - 0.5
+			y := float64(p1.Origin.Y) + (float64(j)+0.5)*scale - 0.5
+			x2, y2 := inv.Apply(x, y)
+			g2.Set(i, j, p2.At(level, x2, y2))
+		}
+	}
+
+	return metric.Score(g1, &g2)
+}
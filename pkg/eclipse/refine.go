@@ -0,0 +1,57 @@
+package eclipse
+
+import(
+	"log"
+	"math"
+
+	"gonum.org/v1/gonum/optimize"
+)
+
+// refineNelderMead polishes a transform found by the grid search,
+// using the Nelder-Mead simplex method (which doesn't need
+// derivatives) to adjust the translation, rotation and scale all at
+// once, on the full-res level of the pyramids.
+//
+// All four params are scaled so that a change of 1.0 moves pixels at
+// the edge of the input area by roughly one pixel, so the simplex
+// doesn't have to deal with wildly different units.
+func refineNelderMead(cfg Config, p1, p2 lumPyramid, metric AlignmentMetric, start AlignmentTransform) AlignmentTransform {
+	radius := math.Max(float64(cfg.InputArea.Dx()), float64(cfg.InputArea.Dy())) / 2.0
+
+	toXForm := func(x []float64) AlignmentTransform {
+		xform := start
+		xform.TranslateByX = x[0]
+		xform.TranslateByY = x[1]
+		xform.RotateByDeg  = (x[2] / radius) * 180.0 / math.Pi
+		xform.ScaleBy      = 1.0 + x[3]/radius
+		return xform
+	}
+	initX := []float64{
+		start.TranslateByX,
+		start.TranslateByY,
+		start.RotateByDeg * math.Pi / 180.0 * radius,
+		(start.Scale() - 1.0) * radius,
+	}
+
+	problem := optimize.Problem{
+		Func: func(x []float64) float64 { return p1.Diff(p2, 0, toXForm(x), metric) },
+	}
+	settings := &optimize.Settings{
+		Converger:       &optimize.FunctionConverge{Relative: cfg.AlignRefineTolerance, Iterations: cfg.AlignRefineStallIterations},
+		MajorIterations: cfg.AlignRefineMaxIterations,
+	}
+	method := &optimize.NelderMead{SimplexSize: 0.5} // half a pixel
+
+	result, err := optimize.Minimize(problem, initX, settings, method)
+	if err != nil {
+		log.Printf(" -- neldermead: %v; keeping %s\n", err, start)
+		return start
+	}
+
+	best := toXForm(result.X)
+	best.ErrorMetric = result.F
+	log.Printf(" -- neldermead: %s (%d iterations, %d evaluations, %s)\n", best,
+		result.MajorIterations, result.FuncEvaluations, result.Status)
+
+	return best
+}
@@ -0,0 +1,69 @@
+package eclipse
+
+import(
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+)
+
+// RefLayer returns the layer that the others are aligned to.
+func (fi *FusedImage)RefLayer() *Layer {
+	return &fi.Layers[fi.Reference]
+}
+
+// PickReferenceLayer decides which layer the others get aligned to,
+// as per Config.ReferenceLayer:
+//  - ""       : the first layer (the one with the lowest EV)
+//  - "auto"   : the layer whose lunar limb had the best circle fit
+//  - a number : the layer with the nearest EV
+//  - otherwise: the layer loaded from that file
+// It needs the lunar limbs to have been found already.
+func (fi *FusedImage)PickReferenceLayer() error {
+	want := fi.Config.ReferenceLayer
+	fi.Reference = 0
+
+	switch {
+	case want == "":
+
+	case want == "auto":
+		best := math.Inf(1)
+		for i, l := range fi.Layers {
+			if l.LunarLimb.IsFitted() && l.LunarLimb.FitResidual < best {
+				fi.Reference, best = i, l.LunarLimb.FitResidual
+			}
+		}
+
+	default:
+		if ev, err := strconv.ParseFloat(want, 64); err == nil {
+			for i, l := range fi.Layers {
+				if math.Abs(l.EV - ev) < math.Abs(fi.RefLayer().EV - ev) {
+					fi.Reference = i
+				}
+			}
+		} else if i := fi.findLayer(want); i >= 0 {
+			fi.Reference = i
+		} else {
+			return fmt.Errorf("reference layer '%s': no such file loaded", want)
+		}
+	}
+
+	log.Printf("Reference layer for alignment: %s (%s)\n", fi.RefLayer().Filename(), fi.RefLayer().LunarLimb)
+	return nil
+}
+
+// findLayer returns the index of the layer loaded from the file (or
+// which has it in its stack); -1 if there isn't one.
+func (fi *FusedImage)findLayer(filename string) int {
+	for i, l := range fi.Layers {
+		if l.Filename() == filename || l.LoadFilename == filename {
+			return i
+		}
+		for _, f := range l.StackedFilenames {
+			if f == filename {
+				return i
+			}
+		}
+	}
+	return -1
+}
@@ -0,0 +1,144 @@
+package eclipse
+
+import(
+	"fmt"
+	"image"
+	"log"
+	"math"
+
+	"gonum.org/v1/gonum/mat"
+
+	"github.com/abworrall/eclipse-hdr/pkg/ecolor"
+)
+
+// EstimateResponseCurve recovers the camera's response curve from the
+// exposure bracket itself, using the algorithm from Debevec & Malik
+// '97, "Recovering High Dynamic Range Radiance Maps from
+// Photographs". It needs the layers to be aligned, so that a pixel
+// location sees the same bit of sky (i.e. the same irradiance) in
+// every layer; each layer then gives us a reading for that irradiance
+// at a different exposure, which constrains the curve.
+//
+// The curve ends up in fi.Config.ResponseCurve, where the fusion
+// stage will use it to linearize the layers. Like fine-tuned
+// alignments, you should save it into your conf.yaml.
+func (fi *FusedImage)EstimateResponseCurve() error {
+	if len(fi.Layers) < 2 {
+		return fmt.Errorf("need at least two layers to estimate a response curve")
+	}
+
+	samples := fi.pickResponseSamples(fi.InputArea, 15)
+	if len(samples) < 10 {
+		return fmt.Errorf("only found %d usable sample points for response curve", len(samples))
+	}
+
+	log.Printf("Estimating response curve, from %d sample points over %d layers\n", len(samples), len(fi.Layers))
+
+	tables := [3][]float64{}
+	for ch:=0; ch<3; ch++ {
+		g, err := fi.solveResponseChannel(samples, ch)
+		if err != nil {
+			return fmt.Errorf("response curve, channel %d: %v", ch, err)
+		}
+		tables[ch] = ecolor.NewResponseTable(g)
+	}
+
+	fi.Config.ResponseCurve = ecolor.ResponseCurve{R: tables[0], G: tables[1], B: tables[2]}
+
+	log.Printf("Response curve estimated; save this into conf.yaml:-\n\n%s\n", fi.Config.AsYaml())
+
+	return nil
+}
+
+// pickResponseSamples picks points on a regular grid, skipping any
+// that aren't well exposed in at least two layers (they tell us
+// nothing about the shape of the curve).
+func (fi *FusedImage)pickResponseSamples(bounds image.Rectangle, gridSize int) []image.Point {
+	samples := []image.Point{}
+	stepX := bounds.Dx() / (gridSize+1)
+	stepY := bounds.Dy() / (gridSize+1)
+	if stepX < 1 || stepY < 1 {
+		return samples
+	}
+
+	for i:=1; i<=gridSize; i++ {
+		for j:=1; j<=gridSize; j++ {
+			pt := image.Point{bounds.Min.X + i*stepX, bounds.Min.Y + j*stepY}
+
+			nGood := 0
+			for _, l := range fi.Layers {
+				if gray := ColToGrayU16(l.Image.At(pt.X, pt.Y)); gray > 0x0400 && gray < 0xf000 {
+					nGood++
+				}
+			}
+			if nGood >= 2 {
+				samples = append(samples, pt)
+			}
+		}
+	}
+
+	return samples
+}
+
+// solveResponseChannel sets up the Debevec-Malik linear system for
+// one channel, and solves it in a least squares sense. The unknowns
+// are g(z) for each response level z, and the log irradiance ln(E_i)
+// for each sample point i:
+//
+//   w(Z_ij) * [g(Z_ij) - ln(E_i)] = w(Z_ij) * ln(exposure_j)   one per sample, per layer
+//   g(mid) = 0                                                 fixes the arbitrary constant
+//   lambda * w(z) * [g(z-1) - 2g(z) + g(z+1)] = 0              smoothness, for each level
+//
+// Exposure is proportional to 1/IlluminanceAtMaxExposure.
+func (fi *FusedImage)solveResponseChannel(samples []image.Point, ch int) ([]float64, error) {
+	n       := ecolor.NumResponseLevels
+	nLayers := len(fi.Layers)
+	nRows   := len(samples)*nLayers + 1 + (n-2)
+	nCols   := n + len(samples)
+	lambda  := fi.Config.ResponseCurveSmoothness
+
+	weight := func(z int) float64 {
+		if z <= n/2 {
+			return float64(z) + 1.0
+		}
+		return float64(n-z)
+	}
+
+	A := mat.NewDense(nRows, nCols, nil)
+	b := mat.NewVecDense(nRows, nil)
+	row := 0
+
+	for i, pt := range samples {
+		for _, l := range fi.Layers {
+			r, g, bl, _ := l.Image.At(pt.X, pt.Y).RGBA()
+			z := ecolor.ResponseLevel([3]uint32{r, g, bl}[ch])
+			w := weight(z)
+			A.Set(row, z,   w)
+			A.Set(row, n+i, -w)
+			b.SetVec(row, w * math.Log(1.0 / l.ExposureValue.IlluminanceAtMaxExposure))
+			row++
+		}
+	}
+
+	A.Set(row, n/2, 1.0)
+	row++
+
+	for z:=1; z<n-1; z++ {
+		w := lambda * weight(z)
+		A.Set(row, z-1,  w)
+		A.Set(row, z,   -2.0*w)
+		A.Set(row, z+1,  w)
+		row++
+	}
+
+	var x mat.VecDense
+	if err := x.SolveVec(A, b); err != nil {
+		return nil, err
+	}
+
+	g := make([]float64, n)
+	for z:=0; z<n; z++ {
+		g[z] = x.AtVec(z)
+	}
+	return g, nil
+}
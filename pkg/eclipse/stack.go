@@ -0,0 +1,127 @@
+package eclipse
+
+import(
+	"image"
+	"image/color"
+	"log"
+	"math"
+	"sort"
+)
+
+// sameExposure is true if the two photos were taken with identical settings.
+func sameExposure(ev1, ev2 ExposureValue) bool {
+	return ev1.ISO == ev2.ISO && ev1.FNumber == ev2.FNumber && ev1.ShutterSpeed == ev2.ShutterSpeed
+}
+
+// StackLayers looks for layers that were taken with the same exposure
+// settings (e.g. a burst of shots at each shutter speed), and replaces
+// each group with a single layer, whose image is the sigma-clipped
+// average of the group. This gives lower noise in the fused image.
+//
+// The layers need to have been aligned first, as it stacks the aligned
+// images, and it only stacks the InputArea.
+func (fi *FusedImage)StackLayers() {
+	groups := [][]Layer{}
+	for _, l := range fi.Layers {
+		found := false
+		for i := range groups {
+			if sameExposure(groups[i][0].ExposureValue, l.ExposureValue) {
+				groups[i] = append(groups[i], l)
+				found = true
+				break
+			}
+		}
+		if !found {
+			groups = append(groups, []Layer{l})
+		}
+	}
+
+	if len(groups) == len(fi.Layers) {
+		return // nothing to stack
+	}
+
+	// The reference layer keeps its place as the head of its stack, so
+	// its lunar limb etc. still describe the aligned images.
+	refName := fi.RefLayer().Filename()
+
+	fi.Layers = fi.Layers[:0]
+	for _, group := range groups {
+		if len(group) == 1 {
+			fi.AddLayer(group[0])
+			continue
+		}
+
+		stacked := group[0]
+		for _, l := range group {
+			if l.Filename() == refName {
+				stacked = l
+			}
+		}
+		stacked.StackedFilenames = []string{}
+		for _, l := range group {
+			stacked.StackedFilenames = append(stacked.StackedFilenames, l.Filename())
+		}
+		stacked.Image, stacked.NumRejected = sigmaClipAverage(group, fi.InputArea, fi.Config.StackSigmaClip)
+
+		log.Printf("Stacked %d layers with %s: %v\n", len(group), stacked.ExposureValue, stacked.StackedFilenames)
+		fi.AddLayer(stacked)
+	}
+
+	fi.Reference = fi.findLayer(refName)
+}
+
+// sigmaClipAverage averages the aligned images over `bounds`, one
+// channel at a time. Any sample more than `kappa` std devs away from
+// the median for that pixel (e.g. a hot pixel, or a plane) is
+// rejected, and the remaining samples averaged. (We clip around the
+// median rather than the mean, as with only 3-5 frames an outlier
+// drags the mean so far that it could never be clipped.) Returns the
+// new image, and how many samples were rejected.
+func sigmaClipAverage(layers []Layer, bounds image.Rectangle, kappa float64) (image.Image, int) {
+	out       := image.NewRGBA64(bounds)
+	vals      := make([][3]float64, len(layers))
+	sorted    := make([]float64, len(layers))
+	nRejected := 0
+
+	for x:=bounds.Min.X; x<bounds.Max.X; x++ {
+		for y:=bounds.Min.Y; y<bounds.Max.Y; y++ {
+			for i, l := range layers {
+				r, g, b, _ := l.Image.At(x, y).RGBA()
+				vals[i] = [3]float64{float64(r), float64(g), float64(b)}
+			}
+
+			avg := [3]uint16{}
+			for ch:=0; ch<3; ch++ {
+				sum, sumSq := 0.0, 0.0
+				for i := range vals {
+					sum   += vals[i][ch]
+					sumSq += vals[i][ch] * vals[i][ch]
+					sorted[i] = vals[i][ch]
+				}
+				n      := float64(len(vals))
+				mean   := sum / n
+				stddev := math.Sqrt(math.Max(sumSq/n - mean*mean, 0.0))
+				sort.Float64s(sorted)
+				median := sorted[len(sorted)/2]
+
+				keptSum, nKept := 0.0, 0
+				for i := range vals {
+					if stddev > 0.0 && math.Abs(vals[i][ch] - median) > kappa * stddev {
+						nRejected++
+						continue
+					}
+					keptSum += vals[i][ch]
+					nKept++
+				}
+				if nKept == 0 {
+					keptSum, nKept = sum, len(vals)
+				}
+				avg[ch] = uint16(keptSum / float64(nKept))
+			}
+
+			out.SetRGBA64(x, y, color.RGBA64{avg[0], avg[1], avg[2], 0xFFFF})
+		}
+	}
+
+	return out, nRejected
+}
@@ -7,10 +7,11 @@ import(
 	"github.com/mdouchement/hdr/tmo"
 
 	"github.com/abworrall/eclipse-hdr/pkg/fattal02"
+	"github.com/abworrall/eclipse-hdr/pkg/nrgf"
 )
 
 var(
-	Tonemappers = []string{"drago03", "durand", "fattal02", "icam06", "linear", "reinhard05"}
+	Tonemappers = []string{"drago03", "durand", "fattal02", "icam06", "linear", "nrgf", "reinhard05"}
 )
 
 func ListTonemappers() string {
@@ -36,12 +37,10 @@ func (fi *FusedImage)ApplyTonemapper(op tmo.ToneMappingOperator, name string) {
 	
 	WritePNG(newImg, fmt.Sprintf("tmo-%s.png", name))
 
-	for x:=0; x<fi.Bounds().Dx(); x++ {
-		for y:=0; y<fi.Bounds().Dy(); y++ {
-			p := fi.PixRW(x, y)
-			p.TonemappedRGB = newImg.At(x, y)
-		}
-	}	
+	for _, pt := range DebugPixels {
+		r, g, b, _ := newImg.At(pt.X, pt.Y).RGBA()
+		log.Printf("Tonemapped(%s) @(%d,%d): [0x%04X, 0x%04X, 0x%04X]\n", name, pt.X, pt.Y, r, g, b)
+	}
 }
 
 // Tweak the tmo parameters to better handle eclipse photos. By default, they
@@ -75,6 +74,10 @@ func (fi *FusedImage)SetupTonemapper(name string) tmo.ToneMappingOperator {
 	case "linear":
 		return tmo.NewLinear(fi)
 
+	case "nrgf":
+		center, radius := fi.LunarLimbInOutputArea()
+		return nrgf.NewDefaultNRGF(fi, center, radius)
+
 	case "reinhard05":
 		op := tmo.NewDefaultReinhard05(fi)
 		op.Chromatic  = 0.005
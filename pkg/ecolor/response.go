@@ -0,0 +1,76 @@
+package ecolor
+
+import(
+	"image/color"
+	"math"
+)
+
+// A ResponseCurve maps the values the camera wrote into the image
+// file, back into linear sensor readings. For DNG stage 3 data the
+// camera response is already linear, and we don't need one; but TIFFs
+// that have passed through other software often aren't quite linear.
+//
+// Each channel is a lookup table of NumResponseLevels values, evenly
+// spaced across the input range [0, 0xFFFF]; the values are linear,
+// in [0.0, 1.0]-ish. Values between levels are interpolated.
+type ResponseCurve struct {
+	R []float64
+	G []float64
+	B []float64
+}
+
+const NumResponseLevels = 256
+
+func (rc ResponseCurve)IsLinear() bool {
+	return len(rc.R) == 0 || len(rc.G) == 0 || len(rc.B) == 0
+}
+
+// ResponseLevel maps a 16 bit channel value into the range [0, NumResponseLevels-1]
+func ResponseLevel(v uint32) int {
+	return int(v) * (NumResponseLevels-1) / 0xFFFF
+}
+
+// linearize maps a channel value in the range [0, 0xFFFF] onto the
+// curve, interpolating between the two nearest levels.
+func linearize(table []float64, v uint32) float64 {
+	pos := float64(v) * float64(len(table)-1) / float64(0xFFFF)
+	i   := int(pos)
+	if i >= len(table)-1 {
+		return table[len(table)-1]
+	}
+	frac := pos - float64(i)
+	return table[i]*(1.0-frac) + table[i+1]*frac
+}
+
+// NewCameraNativeWithResponse is like NewCameraNative, but first
+// undoes the camera response curve, if there is one.
+func NewCameraNativeWithResponse(col color.Color, illumAtMax float64, rc ResponseCurve) CameraNative {
+	if rc.IsLinear() {
+		return NewCameraNative(col, illumAtMax)
+	}
+
+	r, g, b, _ := col.RGBA()
+
+	cn := CameraNative{IllumAtMax: illumAtMax}
+	cn.RGB.R = linearize(rc.R, r)
+	cn.RGB.G = linearize(rc.G, g)
+	cn.RGB.B = linearize(rc.B, b)
+	return cn
+}
+
+// NewResponseTable turns the log response `g` that comes out of a
+// Debevec-Malik solve (g(z) = ln(exposure) + ln(irradiance)) into a
+// lookup table for a ResponseCurve. `g` is only defined up to a
+// constant, so we pin it so that the midpoint level maps to the same
+// value that a linear response would give.
+func NewResponseTable(g []float64) []float64 {
+	mid   := len(g) / 2
+	scale := float64(mid) / float64(len(g)-1)
+
+	table := make([]float64, len(g))
+	for z:=0; z<len(g); z++ {
+		table[z] = math.Exp(g[z] - g[mid]) * scale
+	}
+	table[0] = 0.0 // black is black
+	return table
+}
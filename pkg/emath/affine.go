@@ -23,6 +23,21 @@ func (p Aff3)Mult(q Aff3) Aff3 {
 	}
 }
 
+// Invert returns the transform that undoes this one.
+func (m Aff3)Invert() Aff3 {
+	det := m[0]*m[4] - m[1]*m[3]
+	a, b, d, e := m[4]/det, -1*m[1]/det, -1*m[3]/det, m[0]/det
+	return Aff3{
+		a, b, -1*(a*m[2] + b*m[5]),
+		d, e, -1*(d*m[2] + e*m[5]),
+	}
+}
+
+// Apply maps the point (x,y) through the transform.
+func (m Aff3)Apply(x, y float64) (float64, float64) {
+	return m[0]*x + m[1]*y + m[2], m[3]*x + m[4]*y + m[5]
+}
+
 func Identity() Aff3 {
 	return Aff3{1, 0, 0,   0, 1, 0}
 }
@@ -37,11 +52,19 @@ func (m1 Aff3)Rotate(thetaDeg float64) Aff3 {
 	return m1.Mult(Aff3{cosTheta, -1*sinTheta, 0,    sinTheta, cosTheta, 0})
 }
 
+func (m1 Aff3)Scale(s float64) Aff3 {
+	return m1.Mult(Aff3{s, 0, 0,   0, s, 0})
+}
+
 func RotateAbout(thetaDeg, x, y float64) Aff3 {
 	// Remember they compose back to front - rightmost operations performed first
 	return Identity().Translate(x, y).Rotate(thetaDeg).Translate(-1*x, -1*y)
 }
 
+func ScaleAbout(s, x, y float64) Aff3 {
+	return Identity().Translate(x, y).Scale(s).Translate(-1*x, -1*y)
+}
+
 // Actual 3x3 matrixes, used for color transforms
 type Vec3 f64.Vec3
 type Mat3 f64.Mat3
@@ -106,6 +106,27 @@ func (H *FloatGrid)CalculateGradients(depth int) (FloatGrid, float64) {
   return G, (avgGrad / float64(width*height))
 }
 
+// Interpolate returns the value at a fractional location, using bilinear
+// interpolation. Locations outside the grid are clamped to the edge.
+func (fg *FloatGrid)Interpolate(x, y float64) float64 {
+	maxX := float64(fg.Dx()-1)
+	maxY := float64(fg.Dy()-1)
+	if x < 0.0  { x = 0.0 }
+	if y < 0.0  { y = 0.0 }
+	if x > maxX { x = maxX }
+	if y > maxY { y = maxY }
+
+	x0, y0 := int(x), int(y)
+	x1, y1 := x0+1, y0+1
+	if x1 > fg.Dx()-1 { x1 = x0 }
+	if y1 > fg.Dy()-1 { y1 = y0 }
+	fx, fy := x - float64(x0), y - float64(y0)
+
+	top    := fg.Get(x0,y0)*(1.0-fx) + fg.Get(x1,y0)*fx
+	bottom := fg.Get(x0,y1)*(1.0-fx) + fg.Get(x1,y1)*fx
+	return top*(1.0-fy) + bottom*fy
+}
+
 // DownSample returns a grid that is 1/4 of the size, averaging the values from the
 // original.
 func (g1 *FloatGrid)DownSample() FloatGrid {
@@ -0,0 +1,143 @@
+package emath
+
+import(
+	"math"
+	"math/cmplx"
+)
+
+// Sizes of the log-polar grids; angles cover 180deg, as the magnitude
+// spectrum is symmetric.
+const(
+	logPolarAngles = 720 // 0.25 deg per row
+	logPolarRadii  = 256
+)
+
+// LogPolarCorrelate does Fourier-Mellin registration; it finds the
+// rotation (in degrees) and scale that best map grid `b` onto grid
+// `a`, regardless of any translation between them. (Which you then
+// need to find separately, e.g. with PhaseCorrelate, after having
+// rotated & scaled `b`.) Also returns the height of the correlation
+// peak.
+//
+// It works because the magnitude of a Fourier transform ignores
+// translation; rotating an image rotates its spectrum, and scaling
+// it scales the spectrum the other way. If we resample the spectra
+// into log-polar coords, both of those become translations, which
+// phase correlation can find.
+//
+// Rotations are only unambiguous within +/-90 deg. Anything
+// rotationally symmetric should be removed first, e.g. via
+// SubtractRadialProfile.
+func LogPolarCorrelate(a, b FloatGrid) (float64, float64, float64) {
+	rMin := 4.0 / math.Min(float64(a.Dx()), float64(a.Dy())) // ignore the lowest frequencies
+	rMax := 0.5                                               // Nyquist, in cycles per pixel
+
+	la := a.logPolarSpectrum(rMin, rMax)
+	lb := b.logPolarSpectrum(rMin, rMax)
+
+	// x is log radius, y is angle. The angle axis wraps around, so only
+	// taper off the ends of the radius axis. We don't whiten, as the
+	// resampling leaves faint patterns that line up with the pixel grid,
+	// which phase correlation would latch on to.
+	w := func(x, y int) float64 { return hann(x, logPolarRadii) }
+	dRho, dTheta, peak := correlate(la.toWindowedComplex(w), lb.toWindowedComplex(w), false)
+
+	logStep := math.Log(rMax/rMin) / float64(logPolarRadii-1)
+	rotDeg  := dTheta * 180.0 / float64(logPolarAngles)
+	scale   := math.Exp(-dRho * logStep)
+
+	return rotDeg, scale, peak
+}
+
+// logPolarSpectrum computes the high-pass filtered magnitude spectrum
+// of the grid, and resamples it onto a log-polar grid. Radii are in
+// cycles per pixel, so that non-square grids work.
+func (fg *FloatGrid)logPolarSpectrum(rMin, rMax float64) FloatGrid {
+	width  := fg.Dx()
+	height := fg.Dy()
+
+	spectrum := fg.toWindowedComplex(radialHannWindow(width, height))
+	spectrum.FFT(false)
+
+	// Shift the zero frequency into the middle, and take the magnitude
+	mag := NewFloatGrid(width, height)
+	for y:=0; y<height; y++ {
+		for x:=0; x<width; x++ {
+			mag.Set((x+width/2)%width, (y+height/2)%height, cmplx.Abs(spectrum.Get(x, y)))
+		}
+	}
+
+	logStep := math.Log(rMax/rMin) / float64(logPolarRadii-1)
+	lp      := NewFloatGrid(logPolarRadii, logPolarAngles)
+
+	for j:=0; j<logPolarAngles; j++ {
+		theta := math.Pi * float64(j) / float64(logPolarAngles)
+		for i:=0; i<logPolarRadii; i++ {
+			r  := rMin * math.Exp(float64(i)*logStep)
+			fx := r * math.Cos(theta)
+			fy := r * math.Sin(theta)
+
+			// A high-pass filter, as per Reddy & Chatterji '96, which
+			// downweights the low frequencies that dominate the spectrum.
+			X  := math.Cos(math.Pi*fx) * math.Cos(math.Pi*fy)
+			hp := (1.0 - X) * (2.0 - X)
+
+			val := mag.Interpolate(fx*float64(width) + float64(width/2), fy*float64(height) + float64(height/2))
+			lp.Set(i, j, math.Log(1.0 + hp*val))
+		}
+	}
+
+	// Anything rotationally symmetric (like the lunar limb !) correlates
+	// perfectly at zero rotation, and swamps everything else; so
+	// subtract the mean over all angles, at each radius.
+	for i:=0; i<logPolarRadii; i++ {
+		mean := 0.0
+		for j:=0; j<logPolarAngles; j++ {
+			mean += lp.Get(i, j)
+		}
+		mean /= float64(logPolarAngles)
+		for j:=0; j<logPolarAngles; j++ {
+			lp.Set(i, j, lp.Get(i, j) - mean)
+		}
+	}
+
+	return lp
+}
+
+// SubtractRadialProfile subtracts the average value at each distance
+// from (cx,cy), leaving only the things that vary with angle. For
+// eclipses, the lunar disc and the overall fall-off of the corona are
+// both rotationally symmetric, and their sharp edges swamp the
+// spectrum with patterns that don't rotate (the pixel grid
+// staircasing); the streamers are what tell us about rotation.
+func (fg *FloatGrid)SubtractRadialProfile(cx, cy float64) {
+	width  := fg.Dx()
+	height := fg.Dy()
+
+	rMax  := int(math.Hypot(float64(width), float64(height))) + 2
+	sums  := make([]float64, rMax)
+	count := make([]float64, rMax)
+	for y:=0; y<height; y++ {
+		for x:=0; x<width; x++ {
+			r := int(math.Hypot(float64(x)-cx, float64(y)-cy) + 0.5)
+			sums[r]  += fg.Get(x, y)
+			count[r] += 1.0
+		}
+	}
+	for r := range sums {
+		if count[r] > 0 {
+			sums[r] /= count[r]
+		} else if r > 0 {
+			sums[r] = sums[r-1]
+		}
+	}
+
+	for y:=0; y<height; y++ {
+		for x:=0; x<width; x++ {
+			r  := math.Hypot(float64(x)-cx, float64(y)-cy)
+			i  := int(r)
+			fr := r - float64(i)
+			fg.Set(x, y, fg.Get(x, y) - (sums[i]*(1.0-fr) + sums[i+1]*fr))
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package emath
+
+import(
+	"math"
+	"testing"
+)
+
+func TestLogPolarCorrelate(t *testing.T) {
+	const size = 128
+	c := float64(size-1) / 2.0
+	pattern := newBlobs(400, size, size, 2)
+	a := pattern.render(size, size, func(x, y float64) (float64, float64) { return x, y })
+
+	tests := []struct{
+		rotDeg, scale float64
+	}{
+		{0.0, 1.0},
+		{4.0, 1.0},
+		{-7.5, 1.0},
+		{0.0, 1.05},
+		{0.0, 0.95},
+		{3.0, 1.03},
+	}
+
+	for _, test := range tests {
+		// `b` is `a`, transformed back; so transforming `b` by the
+		// rotation & scale (as AlignmentTransform.ToMatrix does) gets `a`.
+		m := RotateAbout(test.rotDeg, c, c).Mult(ScaleAbout(test.scale, c, c))
+		b := pattern.render(size, size, m.Apply)
+
+		rotDeg, scale, peak := LogPolarCorrelate(a, b)
+		if math.Abs(rotDeg - test.rotDeg) > 0.3 || math.Abs(scale - test.scale) > 0.01 {
+			t.Errorf("rotate %.2fdeg, scale %.3f: got %.2fdeg, %.3f", test.rotDeg, test.scale, rotDeg, scale)
+		}
+		if peak < 0.1 {
+			t.Errorf("rotate %.2fdeg, scale %.3f: peak only %.3f", test.rotDeg, test.scale, peak)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package emath
+
+import(
+	"math"
+	"math/cmplx"
+
+	"gonum.org/v1/gonum/dsp/fourier"
+)
+
+// A ComplexGrid is a grid of complex numbers, for working in the frequency domain.
+type ComplexGrid struct {
+	stride int
+	values []complex128
+}
+
+func NewComplexGrid(w, h int) ComplexGrid {
+	return ComplexGrid{
+		stride: w,
+		values: make([]complex128, w*h),
+	}
+}
+
+func (cg *ComplexGrid)Set(x, y int, v complex128) { cg.values[cg.stride*y + x] = v }
+func (cg *ComplexGrid)Get(x, y int) complex128    { return cg.values[cg.stride*y + x] }
+func (cg *ComplexGrid)Dx() int                    { return cg.stride }
+func (cg *ComplexGrid)Dy() int                    { return len(cg.values) / cg.stride }
+
+// FFT performs an in-place 2D discrete Fourier transform (or the
+// inverse, normalized so that a round trip gets back where it
+// started).
+func (cg *ComplexGrid)FFT(inverse bool) {
+	width  := cg.Dx()
+	height := cg.Dy()
+
+	transform := func(t *fourier.CmplxFFT, seq []complex128) {
+		if inverse {
+			t.Sequence(seq, seq)
+			for i := range seq {
+				seq[i] /= complex(float64(len(seq)), 0)
+			}
+		} else {
+			t.Coefficients(seq, seq)
+		}
+	}
+
+	// Rows are contiguous, so transform them in place
+	rowFft := fourier.NewCmplxFFT(width)
+	for y:=0; y<height; y++ {
+		transform(rowFft, cg.values[y*width:(y+1)*width])
+	}
+
+	col    := make([]complex128, height)
+	colFft := fourier.NewCmplxFFT(height)
+	for x:=0; x<width; x++ {
+		for y:=0; y<height; y++ {
+			col[y] = cg.Get(x, y)
+		}
+		transform(colFft, col)
+		for y:=0; y<height; y++ {
+			cg.Set(x, y, col[y])
+		}
+	}
+}
+
+// A window is a weighting function over a grid, used to taper off the
+// edges so they don't dominate the spectrum.
+type window func(x, y int) float64
+
+func hann(i, n int) float64 {
+	if n <= 1 { return 1.0 }
+	return 0.5 - 0.5*math.Cos(2.0*math.Pi*float64(i)/float64(n-1))
+}
+
+// hannWindow tapers off all four edges.
+func hannWindow(width, height int) window {
+	return func(x, y int) float64 { return hann(x, width) * hann(y, height) }
+}
+
+// radialHannWindow tapers off with distance from the center, so it
+// treats all directions the same (which matters if we're looking for
+// rotations).
+func radialHannWindow(width, height int) window {
+	cx, cy := float64(width-1)/2.0, float64(height-1)/2.0
+	rMax   := math.Min(cx, cy)
+	return func(x, y int) float64 {
+		r := math.Hypot(float64(x)-cx, float64(y)-cy)
+		if r >= rMax { return 0.0 }
+		return 0.5 + 0.5*math.Cos(math.Pi*r/rMax)
+	}
+}
+
+// toWindowedComplex subtracts the mean, and applies the window.
+func (fg *FloatGrid)toWindowedComplex(w window) ComplexGrid {
+	width  := fg.Dx()
+	height := fg.Dy()
+
+	mean := 0.0
+	for _, v := range fg.values {
+		mean += v
+	}
+	mean /= float64(len(fg.values))
+
+	cg := NewComplexGrid(width, height)
+	for y:=0; y<height; y++ {
+		for x:=0; x<width; x++ {
+			cg.Set(x, y, complex((fg.Get(x, y) - mean) * w(x, y), 0))
+		}
+	}
+	return cg
+}
+
+// PhaseCorrelate finds the translation that best maps grid `b` onto
+// grid `a` (i.e. a(x,y) ~= b(x-dx, y-dy)), using phase correlation.
+// The peak is then refined to sub-pixel accuracy. Also returns the
+// height of the peak, which is 1.0 for a perfect match, and near zero
+// if nothing matched.
+//
+// The grids must be the same size.
+func PhaseCorrelate(a, b FloatGrid) (float64, float64, float64) {
+	w := hannWindow(a.Dx(), a.Dy())
+	return correlate(a.toWindowedComplex(w), b.toWindowedComplex(w), true)
+}
+
+// correlate does the work for PhaseCorrelate, on grids that have
+// already been windowed. If `whiten` is false, it does plain cross
+// correlation instead, which doesn't amplify weak frequencies (and
+// the peak is then the correlation coefficient).
+func correlate(A, B ComplexGrid, whiten bool) (float64, float64, float64) {
+	width  := A.Dx()
+	height := A.Dy()
+
+	A.FFT(false)
+	B.FFT(false)
+
+	// Without whitening, scale so that a perfect match peaks at 1.0 (via Parseval)
+	norm := 1.0
+	if !whiten {
+		sumA, sumB := 0.0, 0.0
+		for i := range A.values {
+			sumA += real(A.values[i] * cmplx.Conj(A.values[i]))
+			sumB += real(B.values[i] * cmplx.Conj(B.values[i]))
+		}
+		norm = math.Sqrt(sumA*sumB) / float64(width*height)
+	}
+
+	// The (normalized) cross-power spectrum
+	R := NewComplexGrid(width, height)
+	for i := range A.values {
+		cross := A.values[i] * cmplx.Conj(B.values[i])
+		if mag := cmplx.Abs(cross); !whiten && norm > 0.0 {
+			R.values[i] = cross / complex(norm, 0)
+		} else if whiten && mag > 1e-12 {
+			R.values[i] = cross / complex(mag, 0)
+		}
+	}
+
+	corr := NewComplexGrid(width, height)
+	copy(corr.values, R.values)
+	corr.FFT(true)
+
+	// Find the whole-pixel peak
+	peakX, peakY, peak := 0, 0, -1.0
+	for y:=0; y<height; y++ {
+		for x:=0; x<width; x++ {
+			if v := real(corr.Get(x, y)); v > peak {
+				peakX, peakY, peak = x, y, v
+			}
+		}
+	}
+
+	// Shifts past the halfway point are really negative shifts
+	dx, dy := float64(peakX), float64(peakY)
+	if peakX > width/2  { dx -= float64(width) }
+	if peakY > height/2 { dy -= float64(height) }
+
+	// Zoom in around the peak, twice; first to 0.1px, then to 0.01px
+	dx, dy, peak = R.upsampledPeak(dx, dy, 1.0, 10)
+	dx, dy, peak = R.upsampledPeak(dx, dy, 0.1, 10)
+
+	return dx, dy, peak
+}
+
+// upsampledPeak evaluates the inverse DFT of the spectrum `R` on a fine
+// grid of points, spaced (width/n) apart, in a box of +/-width around
+// (cx,cy), and returns the location and height of the highest point.
+// This is a matrix-multiply DFT as per Guizar-Sicairos et al '08,
+// "Efficient subpixel image registration algorithms"; it's separable,
+// so cheap compared to upsampling the whole correlation surface.
+func (R *ComplexGrid)upsampledPeak(cx, cy, width float64, n int) (float64, float64, float64) {
+	W := R.Dx()
+	H := R.Dy()
+	M := 2*n + 1
+
+	// Signed frequency for index k
+	freq := func(k, N int) float64 {
+		if k > N/2 {
+			return float64(k - N)
+		}
+		return float64(k)
+	}
+	offset := func(j int) float64 { return width * float64(j-n) / float64(n) }
+
+	// kernX[u][j] = exp(2πi u (cx+offset(j)) / W)
+	kernX := make([][]complex128, W)
+	for u:=0; u<W; u++ {
+		kernX[u] = make([]complex128, M)
+		for j:=0; j<M; j++ {
+			kernX[u][j] = cmplx.Exp(complex(0, 2.0*math.Pi*freq(u, W)*(cx+offset(j))/float64(W)))
+		}
+	}
+
+	// rowSums[v][j] = sum over u of R(u,v) * kernX[u][j]
+	rowSums := make([][]complex128, H)
+	for v:=0; v<H; v++ {
+		rowSums[v] = make([]complex128, M)
+		for u:=0; u<W; u++ {
+			r := R.Get(u, v)
+			if r == 0 {
+				continue
+			}
+			for j:=0; j<M; j++ {
+				rowSums[v][j] += r * kernX[u][j]
+			}
+		}
+	}
+
+	bestX, bestY, best := cx, cy, math.Inf(-1)
+	for i:=0; i<M; i++ {
+		y := cy + offset(i)
+		sums := make([]complex128, M)
+		for v:=0; v<H; v++ {
+			k := cmplx.Exp(complex(0, 2.0*math.Pi*freq(v, H)*y/float64(H)))
+			for j:=0; j<M; j++ {
+				sums[j] += rowSums[v][j] * k
+			}
+		}
+		for j:=0; j<M; j++ {
+			if val := real(sums[j]) / float64(W*H); val > best {
+				bestX, bestY, best = cx+offset(j), y, val
+			}
+		}
+	}
+
+	return bestX, bestY, best
+}
@@ -0,0 +1,76 @@
+package emath
+
+import(
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// blobs is a smooth random pattern, made of gaussian blobs; it can be
+// sampled anywhere, so shifted (or rotated) copies are exact.
+type blobs []struct{ x, y, sigma, amp float64 }
+
+// The blobs spill over the edges a bit, so shifted copies don't have
+// empty margins.
+func newBlobs(n int, width, height float64, seed int64) blobs {
+	r := rand.New(rand.NewSource(seed))
+	b := make(blobs, n)
+	for i := range b {
+		b[i].x     = r.Float64() * (width+20.0) - 10.0
+		b[i].y     = r.Float64() * (height+20.0) - 10.0
+		b[i].sigma = 1.5 + r.Float64()*3.0
+		b[i].amp   = 0.5 + r.Float64()
+	}
+	return b
+}
+
+func (b blobs)At(x, y float64) float64 {
+	v := 0.0
+	for _, blob := range b {
+		d2 := (x-blob.x)*(x-blob.x) + (y-blob.y)*(y-blob.y)
+		v += blob.amp * math.Exp(-d2 / (2.0 * blob.sigma*blob.sigma))
+	}
+	return v
+}
+
+// render samples the pattern at f(x,y), for every pixel in the grid.
+func (b blobs)render(width, height int, f func(x, y float64) (float64, float64)) FloatGrid {
+	g := NewFloatGrid(width, height)
+	for x:=0; x<width; x++ {
+		for y:=0; y<height; y++ {
+			sx, sy := f(float64(x), float64(y))
+			g.Set(x, y, b.At(sx, sy))
+		}
+	}
+	return g
+}
+
+func TestPhaseCorrelate(t *testing.T) {
+	const width, height = 128, 96
+	pattern := newBlobs(300, width, height, 1)
+	a := pattern.render(width, height, func(x, y float64) (float64, float64) { return x, y })
+
+	tests := []struct{
+		dx, dy float64
+	}{
+		{0, 0},
+		{3, 0},
+		{0, -5},
+		{-4, 7},
+		{1.5, -2.25},
+		{-0.3, 0.6},
+	}
+
+	for _, test := range tests {
+		// a(x,y) == b(x-dx, y-dy)
+		b := pattern.render(width, height, func(x, y float64) (float64, float64) { return x+test.dx, y+test.dy })
+
+		dx, dy, peak := PhaseCorrelate(a, b)
+		if math.Abs(dx - test.dx) > 0.1 || math.Abs(dy - test.dy) > 0.1 {
+			t.Errorf("shift (%.2f,%.2f): got (%.2f,%.2f)", test.dx, test.dy, dx, dy)
+		}
+		if peak < 0.2 {
+			t.Errorf("shift (%.2f,%.2f): peak only %.3f", test.dx, test.dy, peak)
+		}
+	}
+}
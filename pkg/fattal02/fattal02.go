@@ -16,8 +16,9 @@ import(
 )
 
 // Fattal02 is a straightforward port of the C++ implementation from
-// the PFSTMO package. It relies on the fftw3 library, and uses cgo to
-// link to it.
+// the PFSTMO package. By default it relies on the fftw3 library, and
+// uses cgo to link to it; build with `-tags purego` (or CGO_ENABLED=0)
+// to use a pure Go solver instead.
 type Fattal02 struct {
 	// Algo parameters
 	DetailLevel    int
@@ -0,0 +1,54 @@
+package fftw
+
+import(
+	"gonum.org/v1/gonum/dsp/fourier"
+
+	"github.com/abworrall/eclipse-hdr/pkg/emath"
+)
+
+// This is a pure Go replacement for the FFTW3 plan in fftw.go, so
+// that fattal02 can be built without cgo or libfftw3-dev. It gets
+// used (via dct_purego.go) when you build with `-tags purego`, or
+// with CGO_ENABLED=0; it is always compiled, so that the tests can
+// check it against FFTW.
+//
+// The only transform the PDE solver needs is the 2D DCT-I, which is
+// what FFTW calls REDFT00. gonum's fourier.DCT is a port of
+// FFTPACK's COST routine, which has exactly the same (unnormalized)
+// definition:
+//
+//   Y[k] = X[0] + (-1)^k X[n-1] + 2 * sum{j=1..n-2} X[j] cos(pi*j*k/(n-1))
+//
+// so we just apply it along every row, and then along every column.
+
+// dct2dPure runs a 2D DCT-I (FFTW_REDFT00 on both axes) from `in` into `out`.
+func dct2dPure(in, out emath.FloatGrid) {
+	width  := in.Dx()
+	height := in.Dy()
+
+	// Pass 1: transform each row of `in`, and store it in `out`
+	row    := make([]float64, width)
+	rowDct := fourier.NewDCT(width)
+	for y:=0; y<height; y++ {
+		for x:=0; x<width; x++ {
+			row[x] = in.Get(x,y)
+		}
+		rowDct.Transform(row, row)
+		for x:=0; x<width; x++ {
+			out.Set(x,y, row[x])
+		}
+	}
+
+	// Pass 2: transform each column of `out`, in place
+	col    := make([]float64, height)
+	colDct := fourier.NewDCT(height)
+	for x:=0; x<width; x++ {
+		for y:=0; y<height; y++ {
+			col[y] = out.Get(x,y)
+		}
+		colDct.Transform(col, col)
+		for y:=0; y<height; y++ {
+			out.Set(x,y, col[y])
+		}
+	}
+}
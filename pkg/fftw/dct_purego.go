@@ -0,0 +1,10 @@
+//go:build !cgo || purego
+
+package fftw
+
+import "github.com/abworrall/eclipse-hdr/pkg/emath"
+
+// dct2d runs a 2D DCT-I (FFTW_REDFT00 on both axes) from `in` into `out`.
+func dct2d(in, out emath.FloatGrid) {
+	dct2dPure(in, out)
+}
@@ -0,0 +1,21 @@
+//go:build cgo && !purego
+
+package fftw
+
+import(
+	"testing"
+)
+
+func TestFftwMatchesPurego(t *testing.T) {
+	in := randomGrid(testW, testH, 2)
+
+	fftwOut := in.NewFromThis()
+	dct2d(*in.Copy(), fftwOut)
+
+	pureOut := in.NewFromThis()
+	dct2dPure(*in.Copy(), pureOut)
+
+	if d := maxAbsDiff(fftwOut, pureOut); d > 1e-9 {
+		t.Errorf("FFTW and purego DCT-I differ by %g", d)
+	}
+}
@@ -0,0 +1,118 @@
+package fftw
+
+import(
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/abworrall/eclipse-hdr/pkg/emath"
+)
+
+// Sizes are odd/even and non-square, so that a swapped axis shows up.
+const testW, testH = 9, 6
+
+func randomGrid(w, h int, seed int64) emath.FloatGrid {
+	r := rand.New(rand.NewSource(seed))
+	g := emath.NewFloatGrid(w, h)
+	for x:=0; x<w; x++ {
+		for y:=0; y<h; y++ {
+			g.Set(x, y, r.Float64()*2.0 - 1.0)
+		}
+	}
+	return g
+}
+
+// directDct2d evaluates the unnormalized DCT-I (REDFT00) straight from
+// its definition, along both axes at once.
+func directDct2d(in emath.FloatGrid) emath.FloatGrid {
+	width  := in.Dx()
+	height := in.Dy()
+	out    := in.NewFromThis()
+
+	weight := func(j, n int) float64 {
+		if j == 0 || j == n-1 { return 1.0 }
+		return 2.0
+	}
+
+	for kx:=0; kx<width; kx++ {
+		for ky:=0; ky<height; ky++ {
+			sum := 0.0
+			for x:=0; x<width; x++ {
+				for y:=0; y<height; y++ {
+					sum += weight(x, width) * weight(y, height) * in.Get(x, y) *
+						math.Cos(math.Pi * float64(x*kx) / float64(width-1)) *
+						math.Cos(math.Pi * float64(y*ky) / float64(height-1))
+				}
+			}
+			out.Set(kx, ky, sum)
+		}
+	}
+
+	return out
+}
+
+func maxAbsDiff(g1, g2 emath.FloatGrid) float64 {
+	max := 0.0
+	for x:=0; x<g1.Dx(); x++ {
+		for y:=0; y<g1.Dy(); y++ {
+			if d := math.Abs(g1.Get(x, y) - g2.Get(x, y)); d > max {
+				max = d
+			}
+		}
+	}
+	return max
+}
+
+func TestDct2dMatchesDirectSum(t *testing.T) {
+	in := randomGrid(testW, testH, 1)
+	expected := directDct2d(in)
+
+	out := in.NewFromThis()
+	dct2d(*in.Copy(), out)
+
+	if d := maxAbsDiff(out, expected); d > 1e-9 {
+		t.Errorf("dct2d differs from the direct DCT-I sum by %g", d)
+	}
+}
+
+// A product of cosines (with whole periods across the grid) is an
+// eigenvector of the discrete laplacian with Neumann boundaries, so
+// if F is that eigenvector scaled by its eigenvalue, U must be the
+// eigenvector itself (less its max, as SolvePdeFft normalizes to).
+func TestSolvePdeFftNeumann(t *testing.T) {
+	tests := []struct{
+		kx, ky int
+	}{
+		{1, 0},
+		{0, 1},
+		{1, 1},
+		{3, 2},
+	}
+
+	for _, test := range tests {
+		lx := get_lambda(testW)[test.kx]
+		ly := get_lambda(testH)[test.ky]
+
+		U := emath.NewFloatGrid(testW, testH)
+		F := U.NewFromThis()
+		max := math.Inf(-1)
+		for x:=0; x<testW; x++ {
+			for y:=0; y<testH; y++ {
+				u := math.Cos(math.Pi * float64(x*test.kx) / float64(testW-1)) *
+					math.Cos(math.Pi * float64(y*test.ky) / float64(testH-1))
+				U.Set(x, y, u)
+				F.Set(x, y, (lx+ly) * u)
+				if u > max { max = u }
+			}
+		}
+		for x:=0; x<testW; x++ {
+			for y:=0; y<testH; y++ {
+				U.Set(x, y, U.Get(x, y) - max)
+			}
+		}
+
+		if d := maxAbsDiff(SolvePdeFft(F, false), U); d > 1e-9 {
+			t.Errorf("mode (%d,%d): SolvePdeFft differs from the known solution by %g", test.kx, test.ky, d)
+		}
+	}
+}
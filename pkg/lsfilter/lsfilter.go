@@ -0,0 +1,158 @@
+package lsfilter
+
+// Implement the Larson-Sekanina rotational gradient filter, from
+// Larson & Sekanina '84, "Coma morphology and dust-emission pattern of
+// periodic Comet Halley".
+
+import(
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/mdouchement/hdr"
+	"github.com/mdouchement/hdr/hdrcolor"
+
+	"github.com/abworrall/eclipse-hdr/pkg/emath"
+)
+
+// LarsonSekanina subtracts copies of the image that have been rotated
+// (and shifted radially) around the lunar center, from the image
+// itself. Anything that is symmetrical about the center cancels out,
+// and what is left are the edges of structures that run radially,
+// like streamers and plumes:
+//
+//   LS(r,θ) = 2*I(r,θ) - I(r-dr, θ+dθ) - I(r-dr, θ-dθ)
+//
+// It works on log luminance, so the result is a ratio; this keeps it
+// meaningful across the huge dynamic range of the corona.
+type LarsonSekanina struct {
+	// Algo parameters
+	AngleDeg       float64     // dθ, the rotational shift
+	RadialShift    float64     // dr, the radial shift, in pixels
+	Clip           float64     // PNG output range; [-Clip,+Clip] maps to [0.0,1.0]
+
+	centerX        float64     // the lunar center, in image coords
+	centerY        float64
+
+	input          hdr.Image   // HDR image
+	output         image.Image // LDR image, the gradient as gray
+
+	logLuminance   emath.FloatGrid  // log(lum) of the input
+	gradient       emath.FloatGrid  // the LS filter output, in log space
+}
+
+func NewDefaultLarsonSekanina(img hdr.Image, center image.Point) *LarsonSekanina {
+	return &LarsonSekanina{
+		AngleDeg:    2.0,
+		RadialShift: 0.0,
+		Clip:        0.5,
+
+		centerX:     float64(center.X),
+		centerY:     float64(center.Y),
+		input:       img,
+	}
+}
+
+// Perform runs the filter, and returns a grayscale image of the gradient,
+// where mid-gray is "no change". Use Blended() to get the HDR version.
+func (ls *LarsonSekanina)Perform() image.Image {
+	ls.createLogLuminanceGrid()
+	ls.calculateGradient()
+	ls.fillOutputImage()
+
+	return ls.output
+}
+
+// Blended returns a copy of the input HDR image, with the gradient
+// blended back in; weight 0.0 leaves the image as is. Because the
+// gradient is in log space, this scales each pixel by
+// exp(weight*LS), so the pixels all stay positive and the color is
+// preserved. You can then tonemap this (e.g. with fattal02) as usual.
+// It runs the filter first, if Perform() hasn't already.
+func (ls *LarsonSekanina)Blended(weight float64) hdr.Image {
+	if ls.gradient.Dx() == 0 {
+		ls.createLogLuminanceGrid()
+		ls.calculateGradient()
+	}
+
+	bounds := ls.input.Bounds()
+	out    := hdr.NewRGB64(bounds)
+
+	for x:=0; x<bounds.Dx(); x++ {
+		for y:=0; y<bounds.Dy(); y++ {
+			rgb   := ls.input.HDRAt(x + bounds.Min.X, y + bounds.Min.Y).(hdrcolor.RGB)
+			scale := math.Exp(weight * ls.gradient.Get(x, y))
+			out.SetRGB(x + bounds.Min.X, y + bounds.Min.Y, hdrcolor.RGB{
+				R: rgb.R * scale,
+				G: rgb.G * scale,
+				B: rgb.B * scale,
+			})
+		}
+	}
+
+	return out
+}
+
+func (ls *LarsonSekanina)createLogLuminanceGrid() {
+	bounds := ls.input.Bounds()
+	H      := emath.NewFloatGrid(bounds.Dx(), bounds.Dy())
+
+	for x:=0; x<bounds.Dx(); x++ {
+		for y:=0; y<bounds.Dy(); y++ {
+			rgb := ls.input.HDRAt(x + bounds.Min.X, y + bounds.Min.Y)
+			xyz := hdrcolor.XYZModel.Convert(rgb)
+			_, lum, _, _ := xyz.(hdrcolor.Color).HDRXYZA()
+			if lum < 0.0 { lum = 0.0 }
+			H.Set(x, y, math.Log(lum + 0.0001))
+		}
+	}
+
+	ls.logLuminance = H
+}
+
+// polarSample returns the log luminance at the point that is at
+// radius `r` and angle `theta` (radians) from the center.
+func (ls *LarsonSekanina)polarSample(r, theta float64) float64 {
+	if r < 0.0 { r = 0.0 }
+	x := ls.centerX + r * math.Cos(theta)
+	y := ls.centerY + r * math.Sin(theta)
+	return ls.logLuminance.Interpolate(x, y)
+}
+
+func (ls *LarsonSekanina)calculateGradient() {
+	H      := ls.logLuminance
+	G      := H.NewFromThis()
+	dTheta := ls.AngleDeg * math.Pi / 180.0
+
+	for x:=0; x<H.Dx(); x++ {
+		for y:=0; y<H.Dy(); y++ {
+			dx    := float64(x) - ls.centerX
+			dy    := float64(y) - ls.centerY
+			r     := math.Sqrt(dx*dx + dy*dy)
+			theta := math.Atan2(dy, dx)
+
+			val := 2.0 * H.Get(x, y)
+			val -= ls.polarSample(r - ls.RadialShift, theta + dTheta)
+			val -= ls.polarSample(r - ls.RadialShift, theta - dTheta)
+			G.Set(x, y, val)
+		}
+	}
+
+	ls.gradient = G
+}
+
+func (ls *LarsonSekanina)fillOutputImage() {
+	bounds := ls.input.Bounds()
+	out    := image.NewGray16(image.Rectangle{Max:image.Point{bounds.Dx(), bounds.Dy()}})
+
+	for x:=0; x<bounds.Dx(); x++ {
+		for y:=0; y<bounds.Dy(); y++ {
+			val := (ls.gradient.Get(x, y) + ls.Clip) / (2.0 * ls.Clip)
+			if val < 0.0 { val = 0.0 }
+			if val > 1.0 { val = 1.0 }
+			out.SetGray16(x, y, color.Gray16{uint16(val * float64(0xFFFF))})
+		}
+	}
+
+	ls.output = out
+}
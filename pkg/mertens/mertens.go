@@ -0,0 +1,312 @@
+package mertens
+
+// Implement exposure fusion, from Mertens, Kautz & Van Reeth '07,
+// "Exposure Fusion".
+
+import(
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/abworrall/eclipse-hdr/pkg/emath"
+)
+
+// Mertens blends a stack of differently exposed LDR images straight
+// into one LDR image, without building a radiance map or tonemapping
+// it. Each pixel of each input gets a weight, from how much local
+// contrast it has, how saturated it is, and how close it is to
+// mid-gray; the inputs are then blended, using those weights, one
+// level of a Laplacian pyramid at a time (so that the seams between
+// regions taken from different exposures don't show).
+//
+// The inputs should be display-referred (i.e. white balanced, and
+// gamma compressed), and all the same size.
+type Mertens struct {
+	// Algo parameters
+	ContrastWeight    float64 // Exponent for the contrast measure (ω_C in the paper); 0 ignores it
+	SaturationWeight  float64 // Exponent for the saturation measure (ω_S)
+	ExposednessWeight float64 // Exponent for the well-exposedness measure (ω_E)
+	Sigma             float64 // Width of the well-exposedness gaussian, centered on 0.5
+
+	// Our extra params
+	Levels            int     // How many pyramid levels; <=0 means as many as will fit
+
+	inputs            []image.Image
+	output            image.Image
+
+	rgb               [][3]emath.FloatGrid // The inputs, in [0,1]
+	weights           []emath.FloatGrid    // The weight of each input at each pixel; they sum to 1.0
+}
+
+func NewDefaultMertens(inputs []image.Image) *Mertens {
+	return &Mertens{
+		ContrastWeight:    1.0,
+		SaturationWeight:  1.0,
+		ExposednessWeight: 1.0,
+		Sigma:             0.2,
+		inputs:            inputs,
+	}
+}
+
+func (m *Mertens)Perform() image.Image {
+	m.loadInputs()
+	m.calculateWeights()
+	m.blendPyramids()
+
+	return m.output
+}
+
+func (m *Mertens)loadInputs() {
+	bounds := m.inputs[0].Bounds()
+	m.rgb = make([][3]emath.FloatGrid, len(m.inputs))
+
+	for i, img := range m.inputs {
+		for c:=0; c<3; c++ {
+			m.rgb[i][c] = emath.NewFloatGrid(bounds.Dx(), bounds.Dy())
+		}
+		for x:=0; x<bounds.Dx(); x++ {
+			for y:=0; y<bounds.Dy(); y++ {
+				r, g, b, _ := img.At(x + bounds.Min.X, y + bounds.Min.Y).RGBA()
+				m.rgb[i][0].Set(x, y, float64(r) / float64(0xFFFF))
+				m.rgb[i][1].Set(x, y, float64(g) / float64(0xFFFF))
+				m.rgb[i][2].Set(x, y, float64(b) / float64(0xFFFF))
+			}
+		}
+	}
+}
+
+// calculateWeights works out the three quality measures for each
+// pixel in each input, and combines them into a weight; then
+// normalizes the weights, so that at each pixel they sum to 1.0.
+func (m *Mertens)calculateWeights() {
+	width  := m.rgb[0][0].Dx()
+	height := m.rgb[0][0].Dy()
+	m.weights = make([]emath.FloatGrid, len(m.rgb))
+
+	for i, rgb := range m.rgb {
+		gray := emath.NewFloatGrid(width, height)
+		for x:=0; x<width; x++ {
+			for y:=0; y<height; y++ {
+				gray.Set(x, y, (rgb[0].Get(x,y) + rgb[1].Get(x,y) + rgb[2].Get(x,y)) / 3.0)
+			}
+		}
+
+		W := emath.NewFloatGrid(width, height)
+		for x:=0; x<width; x++ {
+			for y:=0; y<height; y++ {
+				// Contrast: the absolute response of a laplacian filter, on the grayscale
+				lap := gray.Get(clamp(x-1, width-1), y) + gray.Get(clamp(x+1, width-1), y) +
+					gray.Get(x, clamp(y-1, height-1)) + gray.Get(x, clamp(y+1, height-1)) - 4.0*gray.Get(x, y)
+				contrast := math.Abs(lap)
+
+				// Saturation: the std dev of the three channels
+				r, g, b := rgb[0].Get(x,y), rgb[1].Get(x,y), rgb[2].Get(x,y)
+				mu := (r + g + b) / 3.0
+				saturation := math.Sqrt(((r-mu)*(r-mu) + (g-mu)*(g-mu) + (b-mu)*(b-mu)) / 3.0)
+
+				// Well-exposedness: how close each channel is to 0.5
+				exposedness := 1.0
+				for _, v := range []float64{r, g, b} {
+					exposedness *= math.Exp(-1.0 * (v-0.5)*(v-0.5) / (2.0 * m.Sigma*m.Sigma))
+				}
+
+				w := math.Pow(contrast, m.ContrastWeight) * math.Pow(saturation, m.SaturationWeight) *
+					math.Pow(exposedness, m.ExposednessWeight)
+				W.Set(x, y, w + 1e-12) // So a pixel that scores zero everywhere still gets an even blend
+			}
+		}
+		m.weights[i] = W
+	}
+
+	for x:=0; x<width; x++ {
+		for y:=0; y<height; y++ {
+			sum := 0.0
+			for i := range m.weights {
+				sum += m.weights[i].Get(x, y)
+			}
+			for i := range m.weights {
+				m.weights[i].Set(x, y, m.weights[i].Get(x, y) / sum)
+			}
+		}
+	}
+}
+
+func (m *Mertens)numLevels() int {
+	if m.Levels > 0 {
+		return m.Levels
+	}
+	// Stop when the top level is a few pixels across
+	n := 1
+	for size := math.Min(float64(m.rgb[0][0].Dx()), float64(m.rgb[0][0].Dy())); size >= 16.0; size /= 2.0 {
+		n++
+	}
+	return n
+}
+
+// blendPyramids builds a Gaussian pyramid of each input's weights, and
+// a Laplacian pyramid of each of its channels; sums them, level by
+// level; and then collapses the result into the output image.
+func (m *Mertens)blendPyramids() {
+	nLevels := m.numLevels()
+
+	out := [3][]emath.FloatGrid{}
+	for i := range m.rgb {
+		weights := gaussianPyramid(m.weights[i], nLevels)
+		for c:=0; c<3; c++ {
+			lap := laplacianPyramid(m.rgb[i][c], nLevels)
+			if out[c] == nil {
+				out[c] = make([]emath.FloatGrid, nLevels)
+				for l:=0; l<nLevels; l++ {
+					out[c][l] = lap[l].NewFromThis()
+				}
+			}
+			for l:=0; l<nLevels; l++ {
+				for x:=0; x<lap[l].Dx(); x++ {
+					for y:=0; y<lap[l].Dy(); y++ {
+						out[c][l].Set(x, y, out[c][l].Get(x,y) + weights[l].Get(x,y) * lap[l].Get(x,y))
+					}
+				}
+			}
+		}
+		m.rgb[i] = [3]emath.FloatGrid{} // Let the garbage collector have it
+	}
+
+	channels := [3]emath.FloatGrid{}
+	for c:=0; c<3; c++ {
+		channels[c] = collapsePyramid(out[c])
+	}
+
+	width, height := channels[0].Dx(), channels[0].Dy()
+	img := image.NewRGBA64(image.Rectangle{Max:image.Point{width, height}})
+	toU16 := func(v float64) uint16 {
+		if v < 0.0 { v = 0.0 }
+		if v > 1.0 { v = 1.0 }
+		return uint16(v * float64(0xFFFF) + 0.5)
+	}
+	for x:=0; x<width; x++ {
+		for y:=0; y<height; y++ {
+			img.SetRGBA64(x, y, color.RGBA64{
+				R: toU16(channels[0].Get(x,y)),
+				G: toU16(channels[1].Get(x,y)),
+				B: toU16(channels[2].Get(x,y)),
+				A: 0xFFFF,
+			})
+		}
+	}
+
+	m.output = img
+}
+
+func clamp(v, max int) int {
+	if v < 0   { return 0 }
+	if v > max { return max }
+	return v
+}
+
+// The 5-tap binomial filter from Burt & Adelson '83, "The Laplacian
+// Pyramid as a Compact Image Code".
+var kernel = [5]float64{1.0/16.0, 4.0/16.0, 6.0/16.0, 4.0/16.0, 1.0/16.0}
+
+// reduce blurs the grid, and then takes every other pixel.
+func reduce(g emath.FloatGrid) emath.FloatGrid {
+	width, height := g.Dx(), g.Dy()
+	w2, h2 := (width+1)/2, (height+1)/2
+
+	T := emath.NewFloatGrid(w2, height)
+	for x:=0; x<w2; x++ {
+		for y:=0; y<height; y++ {
+			t := 0.0
+			for k:=-2; k<=2; k++ {
+				t += kernel[k+2] * g.Get(clamp(2*x+k, width-1), y)
+			}
+			T.Set(x, y, t)
+		}
+	}
+
+	g2 := emath.NewFloatGrid(w2, h2)
+	for x:=0; x<w2; x++ {
+		for y:=0; y<h2; y++ {
+			t := 0.0
+			for k:=-2; k<=2; k++ {
+				t += kernel[k+2] * T.Get(x, clamp(2*y+k, height-1))
+			}
+			g2.Set(x, y, t)
+		}
+	}
+
+	return g2
+}
+
+// expand interpolates the grid up to the given size (which should be
+// about twice as big), using the same filter as reduce.
+func expand(g emath.FloatGrid, width, height int) emath.FloatGrid {
+	gw, gh := g.Dx(), g.Dy()
+
+	// Only the taps that land on an even position pick up a value; there
+	// are half as many of them, so double their weight.
+	T := emath.NewFloatGrid(width, gh)
+	for x:=0; x<width; x++ {
+		for y:=0; y<gh; y++ {
+			t := 0.0
+			for k:=-2; k<=2; k++ {
+				if (x-k) % 2 == 0 {
+					t += 2.0 * kernel[k+2] * g.Get(clamp((x-k)/2, gw-1), y)
+				}
+			}
+			T.Set(x, y, t)
+		}
+	}
+
+	g2 := emath.NewFloatGrid(width, height)
+	for x:=0; x<width; x++ {
+		for y:=0; y<height; y++ {
+			t := 0.0
+			for k:=-2; k<=2; k++ {
+				if (y-k) % 2 == 0 {
+					t += 2.0 * kernel[k+2] * T.Get(x, clamp((y-k)/2, gh-1))
+				}
+			}
+			g2.Set(x, y, t)
+		}
+	}
+
+	return g2
+}
+
+func gaussianPyramid(g emath.FloatGrid, nLevels int) []emath.FloatGrid {
+	pyr := []emath.FloatGrid{g}
+	for l:=1; l<nLevels; l++ {
+		pyr = append(pyr, reduce(pyr[l-1]))
+	}
+	return pyr
+}
+
+// laplacianPyramid stores the detail lost between each level of the
+// gaussian pyramid and the next; the last level is just the last
+// level of the gaussian pyramid.
+func laplacianPyramid(g emath.FloatGrid, nLevels int) []emath.FloatGrid {
+	pyr := gaussianPyramid(*g.Copy(), nLevels)
+	for l:=0; l<nLevels-1; l++ {
+		up := expand(pyr[l+1], pyr[l].Dx(), pyr[l].Dy())
+		for x:=0; x<pyr[l].Dx(); x++ {
+			for y:=0; y<pyr[l].Dy(); y++ {
+				pyr[l].Set(x, y, pyr[l].Get(x,y) - up.Get(x,y))
+			}
+		}
+	}
+	return pyr
+}
+
+func collapsePyramid(pyr []emath.FloatGrid) emath.FloatGrid {
+	g := pyr[len(pyr)-1]
+	for l:=len(pyr)-2; l>=0; l-- {
+		up := expand(g, pyr[l].Dx(), pyr[l].Dy())
+		for x:=0; x<up.Dx(); x++ {
+			for y:=0; y<up.Dy(); y++ {
+				up.Set(x, y, up.Get(x,y) + pyr[l].Get(x,y))
+			}
+		}
+		g = up
+	}
+	return g
+}
@@ -0,0 +1,132 @@
+package mertens
+
+import(
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+// Sizes are odd, so that pyramid levels don't halve evenly.
+const testW, testH = 67, 37
+
+// texture is a colorful, mid-toned pattern, scaled by gain and clipped
+// to [0,1]; it has contrast & saturation everywhere, so every pixel
+// scores.
+func texture(x, y int, gain float64) [3]float64 {
+	rgb := [3]float64{}
+	for c:=0; c<3; c++ {
+		v := 0.5 + 0.15*math.Sin(0.7*float64(x) + 2.1*float64(c)) + 0.1*math.Cos(0.9*float64(y) - 1.3*float64(c))
+		rgb[c] = math.Min(v * gain, 1.0)
+	}
+	return rgb
+}
+
+func toImage(width, height int, f func(x, y int) [3]float64) image.Image {
+	img := image.NewRGBA64(image.Rect(0, 0, width, height))
+	for x:=0; x<width; x++ {
+		for y:=0; y<height; y++ {
+			rgb := f(x, y)
+			img.SetRGBA64(x, y, color.RGBA64{
+				R: uint16(rgb[0] * float64(0xFFFF) + 0.5),
+				G: uint16(rgb[1] * float64(0xFFFF) + 0.5),
+				B: uint16(rgb[2] * float64(0xFFFF) + 0.5),
+				A: 0xFFFF,
+			})
+		}
+	}
+	return img
+}
+
+// channelDiff returns the largest difference, in [0,1] units, between
+// any channel of the two images, over the given columns.
+func channelDiff(img1, img2 image.Image, x0, x1 int) float64 {
+	max := 0.0
+	for x:=x0; x<x1; x++ {
+		for y:=0; y<img1.Bounds().Dy(); y++ {
+			r1, g1, b1, _ := img1.At(x, y).RGBA()
+			r2, g2, b2, _ := img2.At(x, y).RGBA()
+			for _, d := range []float64{float64(r1)-float64(r2), float64(g1)-float64(g2), float64(b1)-float64(b2)} {
+				max = math.Max(max, math.Abs(d) / float64(0xFFFF))
+			}
+		}
+	}
+	return max
+}
+
+// Fusing copies of the same image has to give that image back: the
+// weights are all equal (and sum to one), and collapsing a Laplacian
+// pyramid is lossless.
+func TestIdenticalInputs(t *testing.T) {
+	tests := []struct{
+		n, levels int
+	}{
+		{1, 0},
+		{2, 0},
+		{3, 0},
+		{3, 1},
+		{3, 3},
+	}
+
+	in := toImage(testW, testH, func(x, y int) [3]float64 { return texture(x, y, 1.0) })
+
+	for _, test := range tests {
+		inputs := []image.Image{}
+		for i:=0; i<test.n; i++ {
+			inputs = append(inputs, in)
+		}
+
+		m := NewDefaultMertens(inputs)
+		m.Levels = test.levels
+		out := m.Perform()
+
+		for x:=0; x<testW; x++ {
+			for y:=0; y<testH; y++ {
+				sum := 0.0
+				for i := range m.weights {
+					sum += m.weights[i].Get(x, y)
+				}
+				if math.Abs(sum - 1.0) > 1e-9 {
+					t.Fatalf("%d inputs, %d levels: weights at (%d,%d) sum to %f", test.n, test.levels, x, y, sum)
+				}
+			}
+		}
+
+		if d := channelDiff(in, out, 0, testW); d > 2.0 / float64(0xFFFF) {
+			t.Errorf("%d inputs, %d levels: output differs from the input by %g", test.n, test.levels, d)
+		}
+	}
+}
+
+// One exposure is good on the left and blown out on the right; the
+// other is too dark on the left, and good on the right. The fused
+// image should take each half from the exposure that got it right
+// (the seam in the middle gets blended).
+func TestWellExposedRegions(t *testing.T) {
+	bright := toImage(testW, testH, func(x, y int) [3]float64 {
+		if x < testW/2 { return texture(x, y, 1.0) }
+		return texture(x, y, 4.0)
+	})
+	dark := toImage(testW, testH, func(x, y int) [3]float64 {
+		if x < testW/2 { return texture(x, y, 0.1) }
+		return texture(x, y, 1.0)
+	})
+
+	tests := []struct{
+		name        string
+		x0, x1      int
+		expected    image.Image
+	}{
+		{"left",  0,             testW/2 - 8, bright},
+		{"right", testW/2 + 8,   testW,       dark},
+	}
+
+	for _, order := range [][]image.Image{{bright, dark}, {dark, bright}} {
+		out := NewDefaultMertens(order).Perform()
+		for _, test := range tests {
+			if d := channelDiff(out, test.expected, test.x0, test.x1); d > 0.02 {
+				t.Errorf("%s side: output differs from the well-exposed input by %.3f", test.name, d)
+			}
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package nrgf
+
+// Implement the Normalizing Radial Graded Filter, from Morgan, Habbal
+// & Woo '06, "The Depiction of Coronal Structure in White-Light
+// Images".
+
+import(
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/mdouchement/hdr"
+	"github.com/mdouchement/hdr/hdrcolor"
+
+	"github.com/abworrall/eclipse-hdr/pkg/emath"
+)
+
+// NRGF normalizes the brightness of the corona at each radius. The
+// image is cut up into thin annuli around the lunar center; every
+// pixel has the mean luminance of its annulus subtracted, and is then
+// divided by the std dev of the annulus. So the steep radial falloff
+// of the corona disappears, and what is left is the structure (the
+// streamers, plumes etc.)
+//
+// Radii are all measured in solar radii, where the radius of the lunar
+// limb is taken to be 1.0.
+type NRGF struct {
+	// Algo parameters
+	BinWidth       float64     // How wide each annulus is, in solar radii
+	MinRadius      float64     // Pixels closer to the center than this are black (i.e. the moon)
+	MaxRadius      float64     // Pixels further away than this are black; <=0 means no limit
+	Clip           float64     // Output range, in std devs; [-Clip,+Clip] maps to [0.0,1.0]
+	Saturation     float64     // How much of the input color to keep
+
+	// Our extra params
+	GammaExpand    bool        // whether to perform sRGB gamma expansion on final output
+
+	centerX        float64     // the lunar center, in image coords
+	centerY        float64
+	radius         float64     // the lunar radius in pixels; this is 1.0 solar radii
+
+	input          hdr.Image   // HDR image
+	output         image.Image // LDR image
+
+	lum            emath.FloatGrid  // the luminance of the input
+	normalizedLum  emath.FloatGrid  // the NRGF output, in [0,1]
+}
+
+// NewDefaultNRGF needs to know where the lunar limb is in the input
+// image, as that defines the center and the unit of radial distance.
+func NewDefaultNRGF(img hdr.Image, center image.Point, radius float64) *NRGF {
+	return &NRGF{
+		BinWidth:    0.005,
+		MinRadius:   1.0,
+		MaxRadius:   0.0,
+		Clip:        3.0,
+		Saturation:  0.5,
+		GammaExpand: true,
+
+		centerX:     float64(center.X),
+		centerY:     float64(center.Y),
+		radius:      radius,
+		input:       img,
+	}
+}
+
+// Perform implements `github.com/mdouchement/hdr/tmo.ToneMappingOperator`
+func (n *NRGF)Perform() image.Image {
+	n.createLuminanceGrid()
+	n.normalizeAnnuli()
+	n.fillOutputImage()
+
+	return n.output
+}
+
+// solarRadii returns how far the pixel is from the lunar center, in solar radii
+func (n *NRGF)solarRadii(x, y int) float64 {
+	dx := float64(x) - n.centerX
+	dy := float64(y) - n.centerY
+	return math.Sqrt(dx*dx + dy*dy) / n.radius
+}
+
+func (n *NRGF)inRange(r float64) bool {
+	if r < n.MinRadius {
+		return false
+	} else if n.MaxRadius > 0.0 && r > n.MaxRadius {
+		return false
+	}
+	return true
+}
+
+func (n *NRGF)createLuminanceGrid() {
+	bounds := n.input.Bounds()
+	n.lum = emath.NewFloatGrid(bounds.Dx(), bounds.Dy())
+
+	for x:=0; x<bounds.Dx(); x++ {
+		for y:=0; y<bounds.Dy(); y++ {
+			rgb := n.input.HDRAt(x + bounds.Min.X, y + bounds.Min.Y)
+			xyz := hdrcolor.XYZModel.Convert(rgb)
+			_, lum, _, _ := xyz.(hdrcolor.Color).HDRXYZA()
+			n.lum.Set(x, y, lum)
+		}
+	}
+}
+
+// normalizeAnnuli does the actual NRGF; first pass gathers stats for
+// each annulus, second pass normalizes each pixel using the stats for
+// the annulus it lives in.
+func (n *NRGF)normalizeAnnuli() {
+	width  := n.lum.Dx()
+	height := n.lum.Dy()
+
+	bin := func(r float64) int { return int(r / n.BinWidth) }
+
+	// Figure out how many bins, from the pixel furthest from the center
+	nBins := 1
+	for _, corner := range [][2]int{{0,0}, {width-1,0}, {0,height-1}, {width-1,height-1}} {
+		if b := bin(n.solarRadii(corner[0], corner[1])); b+1 > nBins {
+			nBins = b+1
+		}
+	}
+
+	sum   := make([]float64, nBins)
+	sumSq := make([]float64, nBins)
+	count := make([]int,     nBins)
+
+	for x:=0; x<width; x++ {
+		for y:=0; y<height; y++ {
+			r := n.solarRadii(x, y)
+			if !n.inRange(r) {
+				continue
+			}
+			b   := bin(r)
+			val := n.lum.Get(x, y)
+			sum[b]   += val
+			sumSq[b] += val * val
+			count[b]++
+		}
+	}
+
+	mean   := make([]float64, nBins)
+	stddev := make([]float64, nBins)
+	for b:=0; b<nBins; b++ {
+		if count[b] == 0 {
+			continue
+		}
+		mean[b]   = sum[b] / float64(count[b])
+		variance := sumSq[b]/float64(count[b]) - mean[b]*mean[b]
+		if variance > 0.0 {
+			stddev[b] = math.Sqrt(variance)
+		}
+	}
+
+	L := n.lum.NewFromThis()
+	for x:=0; x<width; x++ {
+		for y:=0; y<height; y++ {
+			r := n.solarRadii(x, y)
+			if !n.inRange(r) {
+				continue // leave it black
+			}
+			b := bin(r)
+			if stddev[b] == 0.0 {
+				continue
+			}
+
+			// Map [-Clip,+Clip] std devs into [0,1]
+			z   := (n.lum.Get(x, y) - mean[b]) / stddev[b]
+			val := (z + n.Clip) / (2.0 * n.Clip)
+			if val < 0.0 { val = 0.0 }
+			if val > 1.0 { val = 1.0 }
+			L.Set(x, y, val)
+		}
+	}
+
+	n.normalizedLum = L
+}
+
+// fillOutputImage takes the color from the input image, and the
+// luminance from the NRGF, in the same way as fattal02.
+func (n *NRGF)fillOutputImage() {
+	bounds := n.input.Bounds()
+	out    := image.NewRGBA64(image.Rectangle{Max:image.Point{bounds.Dx(), bounds.Dy()}})
+
+	MaxOf2 := func(a, b float64) float64 {
+		if a > b { return a }
+		return b
+	}
+
+	// C_out = (C_in / L_before)^s * L_after  (C are colours, L are luminances, s is magic number)
+	for x:=0; x<bounds.Dx(); x++ {
+		for y:=0; y<bounds.Dy(); y++ {
+			epsilon  := 1.0 * 1e-4
+
+			rgb      := n.input.HDRAt(x + bounds.Min.X, y + bounds.Min.Y).(hdrcolor.RGB)
+
+			L_before := MaxOf2( n.lum.Get(x,y), epsilon )
+			L_after  := n.normalizedLum.Get(x,y)
+			C_after  := emath.Vec3{
+				math.Pow( MaxOf2((rgb.R / L_before), 0.0), n.Saturation ) * L_after,
+				math.Pow( MaxOf2((rgb.G / L_before), 0.0), n.Saturation ) * L_after,
+				math.Pow( MaxOf2((rgb.B / L_before), 0.0), n.Saturation ) * L_after,
+			}
+
+			if n.GammaExpand {
+				C_after = emath.GammaExpand_sRGB(C_after)
+			}
+
+			C_after.CeilingAt(1.0) // Clipping, else high vals wraparound
+
+			out.Set(x, y, color.RGBA64{
+				R: uint16(C_after[0] * float64(0xFFFF)),
+				G: uint16(C_after[1] * float64(0xFFFF)),
+				B: uint16(C_after[2] * float64(0xFFFF)),
+				A: 0xFFFF,
+			})
+		}
+	}
+
+	n.output = out
+}